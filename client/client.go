@@ -3,7 +3,11 @@ package client
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
+	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,26 +15,46 @@ import (
 	"github.com/tianhongw/grp/pkg/conn"
 	"github.com/tianhongw/grp/pkg/log"
 	"github.com/tianhongw/grp/pkg/message"
+	"github.com/tianhongw/grp/pkg/mux"
 	"github.com/tianhongw/grp/pkg/proto"
 	"github.com/tianhongw/grp/pkg/util"
+	"github.com/tianhongw/grp/version"
 )
 
 type tunnel struct {
+	// name of the tunnel in the config
+	Name      string
 	PublicUrl string
 	LocalAddr string
 	Protocol  string
+
+	// the local service speaks h2c, which the inspector doesn't parse
+	H2C bool
 }
 
 type Client struct {
 	// client id
 	id string
 
+	// issued by the server with every control, presented on reconnect to
+	// get the same tunnels back
+	resumeToken string
+
 	ctlConn conn.IConn
 
 	log.Logger
 
+	// guards tunnels and tunnelCfgs
+	mu sync.Mutex
+
 	tunnels map[string]*tunnel
 
+	// tunnels to request by name, replaced on reload
+	tunnelCfgs map[string]*conf.TunnelOption
+
+	// signaled once tunnelCfgs is replaced
+	reloadChan chan struct{}
+
 	protocols []proto.Protocol
 
 	cfg *conf.Config
@@ -45,6 +69,11 @@ type Client struct {
 
 	lastPing time.Time
 	lastPong atomic.Value
+
+	// shared by all http proxy connections, nil if nobody inspects the traffic
+	httpWrapper *HttpWrapper
+
+	inspector *inspector
 }
 
 func NewClient(cfg *conf.Config) *Client {
@@ -53,6 +82,9 @@ func NewClient(cfg *conf.Config) *Client {
 		exitChan: make(chan struct{}),
 		lastPing: time.Now(),
 		tunnels:  map[string]*tunnel{},
+
+		tunnelCfgs: cfg.Client.Tunnels,
+		reloadChan: make(chan struct{}, 1),
 	}
 
 	lg, _ := log.NewLogger(cfg.Log.Type,
@@ -60,6 +92,12 @@ func NewClient(cfg *conf.Config) *Client {
 
 	c.Logger = lg
 
+	if cfg.Client.InspectAddr != "" || cfg.Client.HAROutput != "" {
+		c.httpWrapper = NewHttpWrapper()
+		c.inspector = newInspector(c.httpWrapper, cfg.Client.MaxInspectTxns, lg)
+		go c.inspector.run()
+	}
+
 	return c
 }
 
@@ -68,13 +106,113 @@ const (
 	maxWaitTime  = 1 * time.Minute
 )
 
+// errRejected is returned when the server rejects the auth request, either
+// for the credentials or the protocol version, retrying is pointless.
+var errRejected = errors.New("rejected by server")
+
+// errDraining is returned when the server is shutting down, the client
+// reconnects right away, possibly to another server behind the same addr.
+var errDraining = errors.New("server is draining")
+
+// errTunnelsChanged is returned when a reload removes tunnels the server
+// can only release by closing the control, the client reconnects right away.
+var errTunnelsChanged = errors.New("tunnels changed")
+
+// first protocol version knowing the tunnel close message
+const tunnelCloseProtocolVersion = 5
+
+// control is the state of a control connection, owned by the loop.
+type control struct {
+	// serializes the writes of the loop and the heartbeat
+	mu sync.Mutex
+
+	conn  conn.IConn
+	codec message.Codec
+
+	// protocol version of the session
+	version int
+
+	// tunnels requested by name
+	requested map[string]*conf.TunnelOption
+
+	// tunnel names by request id
+	pending map[string]string
+}
+
+func (ctl *control) send(msg message.Message) error {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	return ctl.codec.WriteMsg(ctl.conn, msg)
+}
+
 func (c *Client) Run() error {
+	if c.cfg.Client.TLS {
+		serverName := c.cfg.Client.TLSServerName
+		if serverName == "" {
+			host, _, err := net.SplitHostPort(c.cfg.Client.ServerAddr)
+			if err != nil {
+				return err
+			}
+			serverName = host
+		}
+
+		tlsCfg, err := conn.LoadClientTLSConfig(c.cfg.Client.TLSCA,
+			c.cfg.Client.TLSCrt, c.cfg.Client.TLSKey,
+			serverName, c.cfg.Client.TLSInsecureSkipVerify)
+		if err != nil {
+			c.Errorf("load tls config failed: %v", err)
+			return err
+		}
+		c.tlsCfg = tlsCfg
+	}
+
+	if c.cfg.Client.InspectAddr != "" {
+		if err := c.inspector.listen(c.cfg.Client.InspectAddr); err != nil {
+			c.Errorf("start inspect dashboard failed: %v", err)
+			return err
+		}
+	}
+
+	if c.cfg.Client.HAROutput != "" {
+		c.waitGroup.Wrap(func() {
+			c.inspector.writeHAR(c.cfg.Client.HAROutput, c.exitChan)
+		})
+	}
+
 	wait := 1 * time.Second
 	failCount := 0
 
 	for {
+		start := time.Now()
+
 		err := c.loop()
 
+		select {
+		case <-c.exitChan:
+			return nil
+		default:
+		}
+
+		if errors.Is(err, errRejected) {
+			return err
+		}
+
+		if errors.Is(err, errDraining) || errors.Is(err, errTunnelsChanged) {
+			c.Warningf("%v, reconnecting", err)
+			wait = 1 * time.Second
+			failCount = 0
+			continue
+		}
+
+		c.Errorf("control connection lost: %v", err)
+
+		// a control connection which lived long enough resets the backoff
+		if time.Since(start) > maxWaitTime {
+			wait = 1 * time.Second
+			failCount = 0
+		}
+
 		failCount++
 		if failCount > maxFailCount {
 			return err
@@ -110,9 +248,23 @@ func (c *Client) loop() error {
 
 	defer ctlConn.Close()
 
+	var caps []string
+	if c.cfg.Client.Mux {
+		caps = append(caps, message.CapMux)
+	}
+	for _, codec := range message.SupportedCodecs {
+		caps = append(caps, message.CodecCapability(codec))
+	}
+
 	authReq := &message.AuthRequest{
-		ClientId: c.id,
-		User:     c.cfg.Client.AuthToken,
+		ClientId:      c.id,
+		User:          c.cfg.Client.User,
+		Password:      c.cfg.Client.Password,
+		Token:         c.cfg.Client.AuthToken,
+		Version:       version.ProtocolVersion,
+		ClientVersion: version.Version,
+		Capabilities:  caps,
+		ResumeToken:   c.resumeToken,
 	}
 
 	if err := message.WriteMsg(ctlConn, authReq); err != nil {
@@ -131,80 +283,315 @@ func (c *Client) loop() error {
 
 	if authResp.ErrorMsg != "" {
 		c.Error(authResp.ErrorMsg)
-		return errors.New(authResp.ErrorMsg)
+		return fmt.Errorf("%w: %s", errRejected, authResp.ErrorMsg)
+	}
+
+	if authResp.Version < version.MinProtocolVersion {
+		return fmt.Errorf("%w: unsupported server protocol version: %d", errRejected, authResp.Version)
 	}
 
+	codec := message.CodecFromCapabilities(authResp.Capabilities)
+
 	c.id = authResp.ClientId
+	c.resumeToken = authResp.ResumeToken
 
 	c.Infof("client: %s successfully connect to server, control conn established at: %v",
 		c.id, ctlConn.LocalAddr())
 
-	// request tunnels
-	reqIdToTunnelCfg := make(map[string]*conf.TunnelOption)
-	for _, cfg := range c.cfg.Client.Tunnels {
-		var protocols []string
-		for proto := range cfg.Protocols {
-			protocols = append(protocols, proto)
-		}
+	// servers predating the negotiation don't tell their version
+	serverVersion := authResp.ServerVersion
+	if serverVersion == "" {
+		serverVersion = "unknown"
+	}
+	c.Infof("server version: %s, protocol version: %d, capabilities: %v",
+		serverVersion, authResp.Version, authResp.Capabilities)
 
-		tunnelRequest := &message.TunnelRequest{
-			RequestId:  util.NewStringID(),
-			Protocol:   strings.Join(protocols, ","),
-			HostName:   cfg.HostName,
-			SubDomain:  cfg.SubDomain,
-			HttpAuth:   cfg.HttpAuth,
-			RemotePort: cfg.RemotePort,
-		}
+	multiplexed := message.HasCapability(authResp.Capabilities, message.CapMux)
+	if multiplexed {
+		session := mux.Client(ctlConn)
+		defer session.Close()
 
-		if err := message.WriteMsg(ctlConn, tunnelRequest); err != nil {
+		stream, err := session.Open()
+		if err != nil {
 			return err
 		}
 
-		reqIdToTunnelCfg[tunnelRequest.RequestId] = cfg
+		// control messages go over the first stream, the server opens the
+		// following ones for proxies
+		ctlConn = conn.WrapConn(stream, "control")
+		c.ctlConn = ctlConn
+		defer ctlConn.Close()
+
+		c.waitGroup.Wrap(func() {
+			c.acceptStreams(session, codec)
+		})
+
+		c.Info("multiplexing proxy streams over the control connection")
+	} else if c.cfg.Client.Mux {
+		c.Warning("server does not support multiplexing, dialing a connection per proxy")
 	}
 
-	c.waitGroup.Wrap(c.heartbeat)
+	ctl := &control{
+		conn:      ctlConn,
+		codec:     codec,
+		version:   authResp.Version,
+		requested: make(map[string]*conf.TunnelOption),
+		pending:   make(map[string]string),
+	}
+
+	if err := c.syncTunnels(ctl); err != nil {
+		return err
+	}
+
+	c.lastPong.Store(time.Now())
+
+	done := make(chan struct{})
+	defer close(done)
+
+	c.waitGroup.Wrap(func() {
+		c.heartbeat(ctl, done)
+	})
+
+	// read in the background so reloads are applied while waiting for
+	// messages
+	msgs := make(chan message.Message)
+	readErr := make(chan error, 1)
+	c.waitGroup.Wrap(func() {
+		for {
+			rawMsg, err := codec.ReadMsg(ctlConn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case msgs <- rawMsg:
+			case <-done:
+				return
+			}
+		}
+	})
+
+	draining := false
 
 	for {
+		var rawMsg message.Message
+
 		select {
 		case <-c.exitChan:
 			return errors.New("client exited")
-		default:
-		}
-		rawMsg, err := message.ReadMsg(ctlConn)
-		if err != nil {
+		case err := <-readErr:
+			if draining {
+				return fmt.Errorf("%w: %v", errDraining, err)
+			}
 			return err
+		case <-c.reloadChan:
+			if err := c.syncTunnels(ctl); err != nil {
+				return err
+			}
+			continue
+		case rawMsg = <-msgs:
 		}
 
 		switch m := rawMsg.(type) {
 		case *message.Pong:
 			c.lastPong.Store(time.Now())
 		case *message.TunnelResponse:
+			name := ctl.pending[m.RequestId]
+			cfg, ok := ctl.requested[name]
+			if !ok {
+				// removed by a reload before the server answered
+				if m.ErrorMsg == "" {
+					if err := ctl.send(&message.TunnelClose{URL: m.URL}); err != nil {
+						return err
+					}
+				}
+				continue
+			}
 			if m.ErrorMsg != "" {
-				c.Errorf("new tunnel failed: %v", err)
+				c.Errorf("new %s tunnel failed: %s", m.Protocol, m.ErrorMsg)
 				continue
 			}
 			t := &tunnel{
+				Name:      name,
 				PublicUrl: m.URL,
-				LocalAddr: reqIdToTunnelCfg[m.RequestId].Protocols[m.Protocol],
+				LocalAddr: cfg.Protocols[m.Protocol],
 				Protocol:  m.Protocol,
+				H2C:       cfg.H2C,
 			}
-			c.tunnels[t.PublicUrl] = t
+			c.addTunnel(t)
 			c.Infof("tunnel established, public url: %s, local addr: %s",
 				t.PublicUrl, t.LocalAddr)
+		case *message.TunnelClose:
+			if t, ok := c.removeTunnel(m.URL); ok {
+				c.Warningf("tunnel closed by the server, public url: %s", t.PublicUrl)
+			}
 		case *message.ProxyRequest:
-			c.waitGroup.Wrap(c.proxy)
+			c.waitGroup.Wrap(func() {
+				c.proxy(codec)
+			})
+		case *message.Drain:
+			c.Warningf("server is draining, it closes the connection within %ds", m.DeadlineSec)
+			// proxy connections don't depend on the control connection,
+			// but proxy streams die with it, so wait for the server to
+			// close it once they are done
+			if !multiplexed {
+				return errDraining
+			}
+			draining = true
 		}
 	}
 }
 
+// syncTunnels requests the configured tunnels missing on the control, and
+// closes the ones removed or changed since they were requested.
+func (c *Client) syncTunnels(ctl *control) error {
+	want := c.getTunnelCfgs()
+
+	for name, cfg := range ctl.requested {
+		if newCfg, ok := want[name]; ok && reflect.DeepEqual(newCfg, cfg) {
+			continue
+		}
+
+		// servers predating the tunnel close only release tunnels with
+		// the control
+		if ctl.version < tunnelCloseProtocolVersion {
+			return errTunnelsChanged
+		}
+
+		for _, t := range c.removeTunnels(name) {
+			c.Infof("closing tunnel, public url: %s", t.PublicUrl)
+			if err := ctl.send(&message.TunnelClose{URL: t.PublicUrl}); err != nil {
+				return err
+			}
+		}
+
+		delete(ctl.requested, name)
+		for reqId, n := range ctl.pending {
+			if n == name {
+				delete(ctl.pending, reqId)
+			}
+		}
+	}
+
+	for name, cfg := range want {
+		if _, ok := ctl.requested[name]; ok {
+			continue
+		}
+
+		var protocols []string
+		for proto := range cfg.Protocols {
+			protocols = append(protocols, proto)
+		}
+
+		tunnelRequest := &message.TunnelRequest{
+			RequestId:   util.NewStringID(),
+			Protocol:    strings.Join(protocols, ","),
+			HostName:    cfg.HostName,
+			SubDomain:   cfg.SubDomain,
+			HttpAuth:    cfg.HttpAuth,
+			RemotePort:  cfg.RemotePort,
+			PathPrefix:  cfg.PathPrefix,
+			StripPrefix: cfg.StripPrefix,
+			Group:       cfg.Group,
+			Balance:     cfg.Balance,
+
+			XForwarded:    cfg.XForwarded,
+			RemoveHeaders: cfg.RemoveHeaders,
+			SetHeaders:    cfg.SetHeaders,
+			AddHeaders:    cfg.AddHeaders,
+			HostHeader:    cfg.HostHeader,
+
+			H2C: cfg.H2C,
+		}
+
+		if err := ctl.send(tunnelRequest); err != nil {
+			return err
+		}
+
+		ctl.requested[name] = cfg
+		ctl.pending[tunnelRequest.RequestId] = name
+	}
+
+	return nil
+}
+
+// Reload applies the log level and the tunnels of cfg, new tunnels are
+// requested and removed ones closed without dropping the control
+// connection. The other options need a restart.
+func (c *Client) Reload(cfg *conf.Config) {
+	log.SetGlobalLevel(log.ParseLevel(cfg.Log.Level))
+
+	c.mu.Lock()
+	c.tunnelCfgs = cfg.Client.Tunnels
+	c.mu.Unlock()
+
+	select {
+	case c.reloadChan <- struct{}{}:
+	default:
+	}
+
+	c.Info("config reloaded")
+}
+
+func (c *Client) getTunnelCfgs() map[string]*conf.TunnelOption {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tunnelCfgs
+}
+
+func (c *Client) getTunnel(url string) (*tunnel, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tunnels[url]
+
+	return t, ok
+}
+
+func (c *Client) addTunnel(t *tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tunnels[t.PublicUrl] = t
+}
+
+// removeTunnels forgets the tunnels established for the config name.
+func (c *Client) removeTunnels(name string) []*tunnel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed []*tunnel
+	for url, t := range c.tunnels {
+		if t.Name == name {
+			removed = append(removed, t)
+			delete(c.tunnels, url)
+		}
+	}
+
+	return removed
+}
+
+// removeTunnel forgets the tunnel serving url.
+func (c *Client) removeTunnel(url string) (*tunnel, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tunnels[url]
+	delete(c.tunnels, url)
+
+	return t, ok
+}
+
 const (
 	defaultPingInterval      = 3 * time.Second
 	defaultPongCheckInterval = 10 * time.Second
 )
 
-func (c *Client) heartbeat() {
-	conn := c.ctlConn
+// heartbeat closes the control connection once the server stops answering,
+// which makes the loop return and reconnect.
+func (c *Client) heartbeat(ctl *control, stop chan struct{}) {
 	ping := time.NewTicker(defaultPingInterval)
 	pongCheck := time.NewTicker(defaultPongCheckInterval)
 
@@ -216,9 +603,9 @@ func (c *Client) heartbeat() {
 	for {
 		select {
 		case <-ping.C:
-			if err := message.WriteMsg(conn, &message.Ping{}); err != nil {
+			if err := ctl.send(&message.Ping{}); err != nil {
 				c.Errorf("client write ping message failed: %v", err)
-				go c.Exit()
+				ctl.conn.Close()
 				return
 			}
 			c.lastPing = time.Now()
@@ -226,9 +613,11 @@ func (c *Client) heartbeat() {
 			lastPong := c.lastPong.Load().(time.Time)
 			if c.lastPing.Sub(lastPong) > 2*defaultPingInterval {
 				c.Errorf("client have not recived ping message from server side, last ping at: %v", c.lastPing)
-				go c.Exit()
+				ctl.conn.Close()
 				return
 			}
+		case <-stop:
+			return
 		case <-c.exitChan:
 			return
 		}
@@ -242,10 +631,15 @@ func (c *Client) Exit() error {
 
 	close(c.exitChan)
 
+	// unblock the loop
+	if c.ctlConn != nil {
+		c.ctlConn.Close()
+	}
+
 	c.waitGroup.Wait()
 
-	if err := c.ctlConn.Close(); err != nil {
-		c.Errorf("close control conn failed: %v", err)
+	if c.inspector != nil {
+		c.inspector.exit()
 	}
 
 	c.Infof("client: %s exit success", c.id)
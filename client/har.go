@@ -0,0 +1,321 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tianhongw/grp/version"
+)
+
+// http archive 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+type har struct {
+	Log *harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator *harCreator `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         *harRequest  `json:"request"`
+	Response        *harResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *harTimings  `json:"timings"`
+	Comment         string       `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*harNameValue `json:"cookies"`
+	Headers     []*harNameValue `json:"headers"`
+	QueryString []*harNameValue `json:"queryString"`
+	PostData    *harPostData    `json:"postData,omitempty"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int             `json:"status"`
+	StatusText  string          `json:"statusText"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*harNameValue `json:"cookies"`
+	Headers     []*harNameValue `json:"headers"`
+	Content     *harContent     `json:"content"`
+	RedirectURL string          `json:"redirectURL"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHAR(txns []*HttpTxn) *har {
+	entries := make([]*harEntry, 0, len(txns))
+	for _, txn := range txns {
+		entries = append(entries, newHAREntry(txn))
+	}
+
+	return &har{
+		Log: &harLog{
+			Version: "1.2",
+			Creator: &harCreator{
+				Name:    "nrpc",
+				Version: version.Version,
+			},
+			Entries: entries,
+		},
+	}
+}
+
+func newHAREntry(txn *HttpTxn) *harEntry {
+	req := txn.Req
+	ms := float64(txn.Duration) / float64(time.Millisecond)
+
+	entry := &harEntry{
+		StartedDateTime: txn.Start.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: &harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: make([]*harNameValue, 0),
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+		},
+		// the whole duration is spent waiting for the local service
+		Timings: &harTimings{Wait: ms},
+	}
+
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString,
+				&harNameValue{Name: name, Value: v})
+		}
+	}
+
+	if len(req.BodyBytes) > 0 {
+		text, encoding := harBody(req.BodyBytes)
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     text,
+			Comment:  harBodyComment(encoding, req.BodySize, len(req.BodyBytes)),
+		}
+	}
+
+	if ctx, ok := txn.ConnUserCtx.(*replayCtx); ok {
+		entry.Comment = "replay of " + ctx.replayOf
+	}
+
+	resp := txn.Resp
+	if resp == nil {
+		// no response was read, status 0 as browsers do for aborted requests
+		entry.Response = &harResponse{
+			Cookies:     make([]*harNameValue, 0),
+			Headers:     make([]*harNameValue, 0),
+			Content:     &harContent{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		return entry
+	}
+
+	text, encoding := harBody(resp.BodyBytes)
+	entry.Response = &harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		Content: &harContent{
+			Size:     resp.BodySize,
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  harBodyComment("", resp.BodySize, len(resp.BodyBytes)),
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.BodySize,
+	}
+
+	return entry
+}
+
+func harHeaders(h http.Header) []*harNameValue {
+	headers := make([]*harNameValue, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, &harNameValue{Name: name, Value: v})
+		}
+	}
+
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []*harNameValue {
+	nvs := make([]*harNameValue, 0, len(cookies))
+	for _, c := range cookies {
+		nvs = append(nvs, &harNameValue{Name: c.Name, Value: c.Value})
+	}
+
+	return nvs
+}
+
+// harBody returns the body as text, base64 encoded if it's binary.
+func harBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// harBodyComment notes what the text of a body differs from it by.
+func harBodyComment(encoding string, size int64, captured int) string {
+	var notes []string
+	if encoding != "" {
+		notes = append(notes, "text is "+encoding+" encoded")
+	}
+	if size > int64(captured) {
+		notes = append(notes, fmt.Sprintf("text is truncated to %d of %d bytes", captured, size))
+	}
+
+	return strings.Join(notes, ", ")
+}
+
+func (ins *inspector) handleHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", `attachment; filename="nrpc.har"`)
+	writeJSON(w, http.StatusOK, newHAR(ins.getTxns()))
+}
+
+// writeHAR streams the captured transactions to the file, every one is
+// appended as an entry of the archive which is closed again after it, so the
+// file is a complete archive in between writes.
+func (ins *inspector) writeHAR(file string, exitChan chan struct{}) {
+	sub := ins.subscribe(harSubscriberBufSize)
+	defer ins.unsubscribe(sub)
+
+	w, err := newHARWriter(file)
+	if err != nil {
+		ins.lg.Errorf("create har file: %s failed: %v", file, err)
+		return
+	}
+	defer w.Close()
+
+	for {
+		select {
+		case txn := <-sub:
+			if err := w.add(newHAREntry(txn)); err != nil {
+				ins.lg.Errorf("write har file: %s failed: %v", file, err)
+			}
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+// the archive is written as its head, the entries and its tail, the tail is
+// overwritten by every new entry.
+var harTail = []byte("\n]}}\n")
+
+type harWriter struct {
+	f       *os.File
+	entries int
+}
+
+func newHARWriter(file string) (*harWriter, error) {
+	head, err := json.Marshal(newHAR(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	// cut the empty entries and the closing braces off
+	head = bytes.TrimSuffix(head, []byte("[]}}"))
+
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(append(head, append([]byte("["), harTail...)...)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &harWriter{f: f}, nil
+}
+
+func (w *harWriter) add(entry *harEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.f.Seek(-int64(len(harTail)), io.SeekEnd); err != nil {
+		return err
+	}
+
+	sep := []byte("\n")
+	if w.entries > 0 {
+		sep = []byte(",\n")
+	}
+
+	buf := make([]byte, 0, len(sep)+len(data)+len(harTail))
+	buf = append(append(append(buf, sep...), data...), harTail...)
+
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+
+	w.entries++
+
+	return nil
+}
+
+func (w *harWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// requiredHARFields are the fields har 1.2 requires, by object.
+var requiredHARFields = map[string][]string{
+	"log":      {"version", "creator", "entries"},
+	"creator":  {"name", "version"},
+	"entry":    {"startedDateTime", "time", "request", "response", "cache", "timings"},
+	"request":  {"method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize"},
+	"response": {"status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize"},
+	"content":  {"size", "mimeType"},
+	"timings":  {"send", "wait", "receive"},
+}
+
+func checkHARFields(t *testing.T, kind string, obj map[string]interface{}) {
+	t.Helper()
+
+	for _, field := range requiredHARFields[kind] {
+		if _, ok := obj[field]; !ok {
+			t.Errorf("%s misses %s: %v", kind, field, obj)
+		}
+	}
+}
+
+// checkHAR checks data is an archive of n entries with the required fields.
+func checkHAR(t *testing.T, data []byte, n int) []map[string]interface{} {
+	t.Helper()
+
+	var archive struct {
+		Log map[string]interface{} `json:"log"`
+	}
+	if err := json.Unmarshal(data, &archive); err != nil {
+		t.Fatalf("invalid har: %v\n%s", err, data)
+	}
+
+	checkHARFields(t, "log", archive.Log)
+	if v := archive.Log["version"]; v != "1.2" {
+		t.Errorf("log.version: %v", v)
+	}
+	if creator, ok := archive.Log["creator"].(map[string]interface{}); ok {
+		checkHARFields(t, "creator", creator)
+	}
+
+	raw, _ := archive.Log["entries"].([]interface{})
+	if len(raw) != n {
+		t.Fatalf("%d entries, want %d", len(raw), n)
+	}
+
+	entries := make([]map[string]interface{}, 0, n)
+	for _, e := range raw {
+		entry := e.(map[string]interface{})
+		checkHARFields(t, "entry", entry)
+
+		started, _ := entry["startedDateTime"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, started); err != nil {
+			t.Errorf("startedDateTime: %v", err)
+		}
+
+		timings, _ := entry["timings"].(map[string]interface{})
+		checkHARFields(t, "timings", timings)
+		for name, v := range timings {
+			if ms, ok := v.(float64); !ok || ms < -1 {
+				t.Errorf("timings.%s: %v", name, v)
+			}
+		}
+
+		checkHARFields(t, "request", entry["request"].(map[string]interface{}))
+		resp := entry["response"].(map[string]interface{})
+		checkHARFields(t, "response", resp)
+		checkHARFields(t, "content", resp["content"].(map[string]interface{}))
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestHAR(t *testing.T) {
+	w := NewHttpWrapper()
+
+	ok := captureTxn(t, w,
+		"POST /api/items?id=1&id=2 HTTP/1.1\r\nHost: web.nrp.me\r\nCookie: a=1\r\n"+
+			"Content-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 302 Found\r\nLocation: /next\r\nSet-Cookie: s=2\r\nContent-Type: application/octet-stream\r\n"+
+			"Content-Length: 2\r\n\r\n\xff\xfe")
+	ok.Duration = 1500 * time.Microsecond
+
+	// a request without a response
+	failed := captureTxn(t, w, "GET / HTTP/1.1\r\nHost: web.nrp.me\r\n\r\n", "HTTP/1.1 200 OK\r\n\r\n")
+	failed.Resp = nil
+
+	replayed := captureTxn(t, w, "GET / HTTP/1.1\r\nHost: web.nrp.me\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n")
+	replayed.ConnUserCtx = &replayCtx{tunnel: testTunnel, replayOf: ok.Id}
+
+	data, err := json.Marshal(newHAR([]*HttpTxn{ok, failed, replayed}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := checkHAR(t, data, 3)
+
+	entry := entries[0]
+	if entry["time"] != 1.5 || entry["timings"].(map[string]interface{})["wait"] != 1.5 {
+		t.Errorf("time %v, timings %v", entry["time"], entry["timings"])
+	}
+	if started := entry["startedDateTime"]; started != ok.Start.Format(time.RFC3339Nano) {
+		t.Errorf("startedDateTime: %v", started)
+	}
+
+	req := entry["request"].(map[string]interface{})
+	if req["method"] != "POST" || req["url"] != "http://web.nrp.me/api/items?id=1&id=2" ||
+		req["httpVersion"] != "HTTP/1.1" || req["bodySize"] != 5.0 {
+		t.Errorf("request: %v", req)
+	}
+	if qs := req["queryString"].([]interface{}); len(qs) != 2 {
+		t.Errorf("queryString: %v", qs)
+	}
+	if cookies := req["cookies"].([]interface{}); len(cookies) != 1 {
+		t.Errorf("cookies: %v", cookies)
+	}
+	if post := req["postData"].(map[string]interface{}); post["text"] != "hello" || post["mimeType"] != "text/plain" {
+		t.Errorf("postData: %v", post)
+	}
+
+	resp := entry["response"].(map[string]interface{})
+	if resp["status"] != 302.0 || resp["statusText"] != "Found" || resp["redirectURL"] != "/next" {
+		t.Errorf("response: %v", resp)
+	}
+	if content := resp["content"].(map[string]interface{}); content["text"] != "//4=" || content["encoding"] != "base64" ||
+		content["size"] != 2.0 {
+		t.Errorf("content: %v", content)
+	}
+
+	// aborted requests have status 0
+	if resp := entries[1]["response"].(map[string]interface{}); resp["status"] != 0.0 {
+		t.Errorf("response without a response: %v", resp)
+	}
+	if _, ok := entries[1]["request"].(map[string]interface{})["postData"]; ok {
+		t.Error("postData of a request without a body")
+	}
+
+	if comment := entries[2]["comment"]; comment != "replay of "+ok.Id {
+		t.Errorf("comment of a replay: %v", comment)
+	}
+}
+
+func TestHARWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nrpc.har")
+
+	w, err := newHARWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	read := func() []byte {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// the file is a complete archive after every write
+	checkHAR(t, read(), 0)
+
+	txn := captureTxn(t, NewHttpWrapper(), "GET /x HTTP/1.1\r\nHost: web.nrp.me\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	for n := 1; n <= 3; n++ {
+		if err := w.add(newHAREntry(txn)); err != nil {
+			t.Fatal(err)
+		}
+		checkHAR(t, read(), n)
+	}
+}
+
+func TestInspectorWriteHAR(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nrpc.har")
+	ins := newTestInspector(10)
+
+	exitChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ins.writeHAR(file, exitChan)
+		close(done)
+	}()
+
+	// the writer is subscribed once the file is created
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ins.mu.Lock()
+		n := len(ins.subscribers)
+		ins.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("har writer not subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		captureTxn(t, ins.wrapper, "GET / HTTP/1.1\r\nHost: web.nrp.me\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n")
+	}
+
+	for {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var archive har
+		if json.Unmarshal(data, &archive) == nil && len(archive.Log.Entries) == 2 {
+			checkHAR(t, data, 2)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("har file: %s", data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(exitChan)
+	<-done
+}
@@ -6,7 +6,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"sync"
 	"time"
 
@@ -14,17 +13,28 @@ import (
 	"github.com/tianhongw/grp/pkg/util"
 )
 
+// maxCapturedBodySize caps the bytes of a body kept for inspection, the
+// rest is read and dropped.
+const maxCapturedBodySize = 64 << 10
+
 type HttpRequest struct {
 	*http.Request
+	// at most maxCapturedBodySize bytes of the body
 	BodyBytes []byte
+	// size of the whole body
+	BodySize int64
 }
 
 type HttpResponse struct {
 	*http.Response
+	// at most maxCapturedBodySize bytes of the body
 	BodyBytes []byte
+	// size of the whole body
+	BodySize int64
 }
 
 type HttpTxn struct {
+	Id          string
 	Req         *HttpRequest
 	Resp        *HttpResponse
 	Start       time.Time
@@ -33,13 +43,16 @@ type HttpTxn struct {
 	ConnUserCtx interface{}
 }
 
+// HttpWrapper parses the http traffic of wrapped connections, every
+// transaction is published on Txns once its response is read, or once
+// reading the response failed in which case Resp is nil.
 type HttpWrapper struct {
-	Txns util.Broadcast
+	Txns *util.Broadcast
 }
 
 func NewHttpWrapper() *HttpWrapper {
 	return &HttpWrapper{
-		Txns: *util.NewBroadcast(),
+		Txns: util.NewBroadcast(),
 	}
 }
 
@@ -56,57 +69,57 @@ func (h *HttpWrapper) wrapConn(c conn.IConn, ctx interface{}) conn.IConn {
 func (h *HttpWrapper) readRequest(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interface{}) {
 	defer close(lastTxn)
 
+	// keep consuming so that the traffic is never blocked by the analyzer
+	defer io.Copy(ioutil.Discard, tee.WriteBuffer())
+
 	for {
 		req, err := http.ReadRequest(tee.WriteBuffer())
 		if err != nil {
-			log.Printf("read request failed: %v", err)
+			if err != io.EOF {
+				log.Printf("read request failed: %v", err)
+			}
 			break
 		}
 
-		_, err = httputil.DumpRequest(req, true)
-		if err != nil {
-			log.Printf("dump request failed: %v", err)
-		}
-
 		req.URL.Scheme = "http"
 		req.URL.Host = req.Host
 
 		txn := &HttpTxn{
+			Id:          util.NewStringID(),
 			Start:       time.Now(),
 			ConnUserCtx: connCtx,
 			Req:         &HttpRequest{Request: req},
 		}
 
 		if req.Body != nil {
-			txn.Req.BodyBytes, txn.Req.Body, err = extractBody(req.Body)
+			txn.Req.BodyBytes, txn.Req.BodySize, err = extractBody(req.Body)
 			if err != nil {
 				log.Printf("extract request body failed: %v", err)
 			}
 		}
 
 		lastTxn <- txn
-
-		h.Txns.In() <- txn
 	}
 }
 
 func (h *HttpWrapper) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
+	// keep consuming so that the traffic is never blocked by the analyzer
+	defer io.Copy(ioutil.Discard, tee.ReadBuffer())
+
 	for txn := range lastTxn {
 		resp, err := http.ReadResponse(tee.ReadBuffer(), txn.Req.Request)
 		txn.Duration = time.Since(txn.Start)
 		if err != nil {
 			log.Printf("error reading response from server: %v", err)
+			h.Txns.In() <- txn
 			// no more responses to be read, we're done
 			break
 		}
-		// make sure we read the body of the response so that
-		// we don't block the reader
-		_, _ = httputil.DumpResponse(resp, true)
-
 		txn.Resp = &HttpResponse{Response: resp}
-		// apparently, Body can be nil in some cases
+		// apparently, Body can be nil in some cases, the body is read through
+		// so that the reader isn't blocked
 		if resp.Body != nil {
-			txn.Resp.BodyBytes, txn.Resp.Body, err = extractBody(resp.Body)
+			txn.Resp.BodyBytes, txn.Resp.BodySize, err = extractBody(resp.Body)
 			if err != nil {
 				log.Printf("failed to extract response body: %v", err)
 			}
@@ -125,12 +138,12 @@ func (h *HttpWrapper) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 			// sending bytes to each other
 			wg.Add(2)
 			go func() {
-				ioutil.ReadAll(tee.WriteBuffer())
+				io.Copy(ioutil.Discard, tee.WriteBuffer())
 				wg.Done()
 			}()
 
 			go func() {
-				ioutil.ReadAll(tee.ReadBuffer())
+				io.Copy(ioutil.Discard, tee.ReadBuffer())
 				wg.Done()
 			}()
 
@@ -140,8 +153,15 @@ func (h *HttpWrapper) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 	}
 }
 
-func extractBody(r io.Reader) ([]byte, io.ReadCloser, error) {
+// extractBody reads the whole body, it returns its first
+// maxCapturedBodySize bytes and its size.
+func extractBody(r io.Reader) ([]byte, int64, error) {
 	buf := new(bytes.Buffer)
-	_, err := buf.ReadFrom(r)
-	return buf.Bytes(), ioutil.NopCloser(buf), err
+	n, err := buf.ReadFrom(io.LimitReader(r, maxCapturedBodySize))
+	if err != nil {
+		return buf.Bytes(), n, err
+	}
+
+	rest, err := io.Copy(ioutil.Discard, r)
+	return buf.Bytes(), n + rest, err
 }
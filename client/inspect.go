@@ -0,0 +1,470 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tianhongw/grp/pkg/log"
+)
+
+const (
+	defaultMaxInspectTxns = 100
+	subscriberBufSize     = 16
+	// the har file misses the transactions it falls behind on
+	harSubscriberBufSize = 256
+)
+
+// txnRing keeps the most recent transactions, the oldest one is dropped
+// once it's full.
+type txnRing struct {
+	txns []*HttpTxn
+	next int
+	full bool
+}
+
+func newTxnRing(size int) *txnRing {
+	return &txnRing{txns: make([]*HttpTxn, size)}
+}
+
+func (r *txnRing) add(txn *HttpTxn) {
+	r.txns[r.next] = txn
+	r.next = (r.next + 1) % len(r.txns)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the transactions, oldest first.
+func (r *txnRing) all() []*HttpTxn {
+	if !r.full {
+		return append([]*HttpTxn(nil), r.txns[:r.next]...)
+	}
+
+	return append(append([]*HttpTxn(nil), r.txns[r.next:]...), r.txns[:r.next]...)
+}
+
+// inspector keeps the recent http transactions of the tunnels and serves
+// them to a local web dashboard, new transactions are pushed to the browser
+// with server-sent events.
+type inspector struct {
+	mu   sync.Mutex
+	txns *txnRing
+
+	subscribers map[chan *HttpTxn]struct{}
+
+	wrapper *HttpWrapper
+
+	srv *http.Server
+
+	lg log.Logger
+}
+
+type bodyView struct {
+	Size      int64  `json:"size"`
+	Content   string `json:"content"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+type requestView struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	Body   *bodyView   `json:"body"`
+}
+
+type responseView struct {
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       *bodyView   `json:"body"`
+}
+
+type txnView struct {
+	Id         string        `json:"id"`
+	Tunnel     string        `json:"tunnel"`
+	ReplayOf   string        `json:"replay_of,omitempty"`
+	Start      time.Time     `json:"start"`
+	DurationMs float64       `json:"duration_ms"`
+	Request    *requestView  `json:"request"`
+	Response   *responseView `json:"response,omitempty"`
+}
+
+func newInspector(wrapper *HttpWrapper, maxTxns int, lg log.Logger) *inspector {
+	if maxTxns <= 0 {
+		maxTxns = defaultMaxInspectTxns
+	}
+
+	return &inspector{
+		txns:        newTxnRing(maxTxns),
+		subscribers: make(map[chan *HttpTxn]struct{}),
+		wrapper:     wrapper,
+		lg:          lg,
+	}
+}
+
+// run collects the transactions published by the wrapper, it never stops
+// reading since a blocked listener would block the tunneled traffic.
+func (ins *inspector) run() {
+	ins.collect(ins.wrapper.Txns.Reg())
+}
+
+func (ins *inspector) collect(txns chan interface{}) {
+	for item := range txns {
+		txn, ok := item.(*HttpTxn)
+		if !ok {
+			continue
+		}
+
+		ins.mu.Lock()
+		ins.txns.add(txn)
+
+		for sub := range ins.subscribers {
+			select {
+			case sub <- txn:
+			default:
+				// the subscriber is too slow, it will miss this one
+			}
+		}
+		ins.mu.Unlock()
+	}
+}
+
+func (ins *inspector) listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ins.handleIndex)
+	mux.HandleFunc("/api/txns", ins.handleTxns)
+	mux.HandleFunc("/api/txns/", ins.handleTxn)
+	mux.HandleFunc("/api/stream", ins.handleStream)
+	mux.HandleFunc("/api/har", ins.handleHAR)
+
+	ins.srv = &http.Server{Handler: mux}
+
+	go func() {
+		if err := ins.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			ins.lg.Errorf("inspect server exited: %v", err)
+		}
+	}()
+
+	ins.lg.Infof("inspect dashboard listening on: http://%s", l.Addr())
+
+	return nil
+}
+
+func (ins *inspector) exit() {
+	if ins.srv == nil {
+		return
+	}
+
+	// the event streams never end by themselves, close instead of shutdown
+	if err := ins.srv.Close(); err != nil {
+		ins.lg.Errorf("close inspect server failed: %v", err)
+	}
+}
+
+func (ins *inspector) getTxns() []*HttpTxn {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+
+	return ins.txns.all()
+}
+
+func (ins *inspector) getTxn(id string) *HttpTxn {
+	for _, txn := range ins.getTxns() {
+		if txn.Id == id {
+			return txn
+		}
+	}
+
+	return nil
+}
+
+func (ins *inspector) subscribe(size int) chan *HttpTxn {
+	sub := make(chan *HttpTxn, size)
+
+	ins.mu.Lock()
+	ins.subscribers[sub] = struct{}{}
+	ins.mu.Unlock()
+
+	return sub
+}
+
+func (ins *inspector) unsubscribe(sub chan *HttpTxn) {
+	ins.mu.Lock()
+	delete(ins.subscribers, sub)
+	ins.mu.Unlock()
+}
+
+// handleTxns lists the recent transactions, newest first.
+func (ins *inspector) handleTxns(w http.ResponseWriter, r *http.Request) {
+	txns := ins.getTxns()
+
+	views := make([]*txnView, 0, len(txns))
+	for i := len(txns) - 1; i >= 0; i-- {
+		views = append(views, newTxnView(txns[i]))
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (ins *inspector) handleTxn(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/txns/")
+
+	if strings.HasSuffix(id, "/replay") {
+		ins.handleReplay(w, r, strings.TrimSuffix(id, "/replay"))
+		return
+	}
+
+	txn := ins.getTxn(id)
+	if txn == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no transaction: " + id})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newTxnView(txn))
+}
+
+func (ins *inspector) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := ins.subscribe(subscriberBufSize)
+	defer ins.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case txn := <-sub:
+			data, err := json.Marshal(newTxnView(txn))
+			if err != nil {
+				ins.lg.Errorf("marshal transaction failed: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (ins *inspector) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(inspectPage))
+}
+
+func newTxnView(txn *HttpTxn) *txnView {
+	view := &txnView{
+		Id:         txn.Id,
+		Start:      txn.Start,
+		DurationMs: float64(txn.Duration) / float64(time.Millisecond),
+	}
+
+	if t := txnTunnel(txn); t != nil {
+		view.Tunnel = t.PublicUrl
+	}
+
+	if ctx, ok := txn.ConnUserCtx.(*replayCtx); ok {
+		view.ReplayOf = ctx.replayOf
+	}
+
+	req := txn.Req
+	view.Request = &requestView{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Proto:  req.Proto,
+		Header: req.Header,
+		Body:   newBodyView(req.BodyBytes, req.BodySize),
+	}
+
+	if resp := txn.Resp; resp != nil {
+		view.Response = &responseView{
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Proto:      resp.Proto,
+			Header:     resp.Header,
+			Body:       newBodyView(resp.BodyBytes, resp.BodySize),
+		}
+	}
+
+	return view
+}
+
+func newBodyView(body []byte, size int64) *bodyView {
+	view := &bodyView{
+		Size:      size,
+		Truncated: size > int64(len(body)),
+	}
+
+	// a truncated body may end in the middle of a rune
+	text := body
+	if view.Truncated {
+		text = trimPartialRune(body)
+	}
+
+	if utf8.Valid(text) {
+		view.Content = string(text)
+		return view
+	}
+
+	view.Content = base64.StdEncoding.EncodeToString(body)
+	view.Encoding = "base64"
+
+	return view
+}
+
+// trimPartialRune drops an incomplete utf-8 sequence at the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+
+	return b
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+const inspectPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>nrpc inspect</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow-y: auto; border-right: 1px solid #ddd; }
+#detail { flex: 1; overflow-y: auto; padding: 0 16px; }
+.txn { padding: 6px 10px; border-bottom: 1px solid #eee; cursor: pointer; font-size: 13px; }
+.txn:hover, .txn.active { background: #eef4ff; }
+.status { display: inline-block; width: 36px; font-weight: bold; }
+.err { color: #c00; }
+.meta { color: #888; float: right; }
+textarea { width: 100%; height: 200px; font-family: monospace; font-size: 12px; }
+pre { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; font-size: 12px; }
+</style>
+</head>
+<body>
+<div id="list"><div class="txn"><a href="/api/har" download="nrpc.har">Export HAR</a></div></div>
+<div id="detail"><p>Select a transaction.</p></div>
+<script>
+var txns = {};
+var list = document.getElementById("list");
+var detail = document.getElementById("detail");
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function (c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+  });
+}
+
+function headers(h) {
+  var out = "";
+  Object.keys(h || {}).sort().forEach(function (k) {
+    h[k].forEach(function (v) { out += k + ": " + v + "\n"; });
+  });
+  return out;
+}
+
+function body(b) {
+  if (!b || !b.size) return "";
+  var notes = [];
+  if (b.encoding === "base64") notes.push("base64");
+  if (b.truncated) notes.push("truncated");
+  return (notes.length ? "(" + b.size + " bytes, " + notes.join(", ") + ")\n" : "") + b.content;
+}
+
+function show(id) {
+  var t = txns[id];
+  var prev = document.querySelector(".txn.active");
+  if (prev) prev.classList.remove("active");
+  document.getElementById("t" + id).classList.add("active");
+  var html = "<h3>" + esc(t.request.method + " " + t.request.url) + "</h3>" +
+    "<p>" + esc(t.tunnel) + " &middot; " + t.duration_ms.toFixed(2) + " ms" +
+    (t.replay_of ? " &middot; replay of " + esc(t.replay_of) : "") + "</p>" +
+    "<p><button onclick=\"replay('" + t.id + "', false)\">Replay</button> " +
+    "<button onclick=\"editReplay('" + t.id + "')\">Edit and replay</button></p>" +
+    "<div id=\"edit\"></div>" +
+    "<h4>Request</h4><pre>" + esc(headers(t.request.header)) + "\n" + esc(body(t.request.body)) + "</pre>";
+  if (t.response) {
+    html += "<h4>Response " + esc(t.response.status) + "</h4><pre>" +
+      esc(headers(t.response.header)) + "\n" + esc(body(t.response.body)) + "</pre>";
+  } else {
+    html += "<h4 class=\"err\">No response</h4>";
+  }
+  detail.innerHTML = html;
+}
+
+function editReplay(id) {
+  var t = txns[id];
+  var u = new URL(t.request.url);
+  var edit = {method: t.request.method, path: u.pathname + u.search, header: t.request.header,
+    body: t.request.body.content, body_encoding: t.request.body.encoding || ""};
+  document.getElementById("edit").innerHTML = "<textarea id=\"editjson\"></textarea>" +
+    "<p><button onclick=\"replay('" + id + "', true)\">Send</button></p>";
+  document.getElementById("editjson").value = JSON.stringify(edit, null, 2);
+}
+
+function replay(id, edited) {
+  var body = edited ? document.getElementById("editjson").value : "{}";
+  fetch("/api/txns/" + id + "/replay", {method: "POST", body: body})
+    .then(function (r) { return r.json(); })
+    .then(function (res) { if (res.error) alert(res.error); });
+}
+
+function add(t, prepend) {
+  txns[t.id] = t;
+  var div = document.createElement("div");
+  div.className = "txn";
+  div.id = "t" + t.id;
+  var status = t.response ? t.response.status_code : "ERR";
+  div.innerHTML = "<span class=\"status" + (t.response ? "" : " err") + "\">" + status + "</span>" +
+    esc(t.request.method + " " + t.request.url) +
+    "<span class=\"meta\">" + t.duration_ms.toFixed(1) + " ms</span>";
+  div.onclick = function () { show(t.id); };
+  if (prepend) list.insertBefore(div, list.children[1]); else list.appendChild(div);
+}
+
+fetch("/api/txns").then(function (r) { return r.json(); }).then(function (all) {
+  all.forEach(function (t) { add(t, false); });
+  new EventSource("/api/stream").onmessage = function (e) { add(JSON.parse(e.data), true); };
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/log"
+)
+
+// testConn is a conn.IConn over a net.Conn.
+type testConn struct {
+	net.Conn
+	log.DumbLogger
+}
+
+func (c *testConn) SetType(string) {}
+
+var testTunnel = &tunnel{Name: "web", PublicUrl: "http://web.nrp.me", LocalAddr: "127.0.0.1:8080", Protocol: "http"}
+
+// captureTxn sends the raw request through a connection wrapped by w to a
+// local service answering with the raw response, and returns the captured
+// transaction.
+func captureTxn(t *testing.T, w *HttpWrapper, rawReq, rawResp string) *HttpTxn {
+	t.Helper()
+
+	txns := w.Txns.Reg()
+	defer w.Txns.UnReg(txns)
+
+	local, remote := net.Pipe()
+	go func() {
+		defer local.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(local))
+		if err != nil {
+			t.Errorf("local service read request: %v", err)
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		io.WriteString(local, rawResp)
+	}()
+
+	wrapped := w.wrapConn(&testConn{Conn: remote}, testTunnel)
+	defer wrapped.Close()
+
+	go io.WriteString(wrapped, rawReq)
+
+	resp, err := http.ReadResponse(bufio.NewReader(wrapped), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	select {
+	case item := <-txns:
+		return item.(*HttpTxn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no transaction captured")
+	}
+
+	return nil
+}
+
+func newTestInspector(maxTxns int) *inspector {
+	ins := newInspector(NewHttpWrapper(), maxTxns, log.DummyLogger)
+	// registered before the first transaction is published
+	go ins.collect(ins.wrapper.Txns.Reg())
+
+	return ins
+}
+
+// publish hands txn to the inspector, as the wrapper does once it's read.
+func publish(t *testing.T, ins *inspector, txn *HttpTxn) {
+	t.Helper()
+
+	ins.wrapper.Txns.In() <- txn
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ins.getTxn(txn.Id) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("transaction %s not collected", txn.Id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTxnRing(t *testing.T) {
+	r := newTxnRing(3)
+
+	ids := func() string {
+		var s []string
+		for _, txn := range r.all() {
+			s = append(s, txn.Id)
+		}
+		return strings.Join(s, ",")
+	}
+
+	if got := ids(); got != "" {
+		t.Errorf("empty ring: %s", got)
+	}
+
+	tests := []string{"1", "1,2", "1,2,3", "2,3,4", "3,4,5", "4,5,6", "5,6,7"}
+	for i, want := range tests {
+		r.add(&HttpTxn{Id: fmt.Sprint(i + 1)})
+		if got := ids(); got != want {
+			t.Errorf("after %d adds: %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestInspectorEviction(t *testing.T) {
+	ins := newTestInspector(2)
+
+	for i := 1; i <= 3; i++ {
+		publish(t, ins, &HttpTxn{Id: fmt.Sprint(i), Req: &HttpRequest{Request: httptest.NewRequest("GET", "/", nil)}})
+	}
+
+	if ins.getTxn("1") != nil {
+		t.Error("the oldest transaction is kept")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(ins.handleTxns))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var views []*txnView
+	if err := json.NewDecoder(resp.Body).Decode(&views); err != nil {
+		t.Fatal(err)
+	}
+	// newest first
+	if len(views) != 2 || views[0].Id != "3" || views[1].Id != "2" {
+		t.Errorf("listed transactions: %+v", views)
+	}
+}
+
+func TestInspectorStream(t *testing.T) {
+	ins := newTestInspector(10)
+
+	srv := httptest.NewServer(http.HandlerFunc(ins.handleStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type: %s", ct)
+	}
+
+	// the stream is subscribed once the headers are sent
+	txn := captureTxn(t, ins.wrapper,
+		"POST /api/items?id=1 HTTP/1.1\r\nHost: web.nrp.me\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok")
+
+	events := bufio.NewReader(resp.Body)
+	line, err := events.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("event: %q", line)
+	}
+	if blank, _ := events.ReadString('\n'); blank != "\n" {
+		t.Errorf("event not terminated by a blank line: %q", blank)
+	}
+
+	var view txnView
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &view); err != nil {
+		t.Fatal(err)
+	}
+
+	if view.Id != txn.Id || view.Tunnel != testTunnel.PublicUrl {
+		t.Errorf("streamed %s of %s, want %s of %s", view.Id, view.Tunnel, txn.Id, testTunnel.PublicUrl)
+	}
+	if view.Request.Method != "POST" || view.Request.URL != "http://web.nrp.me/api/items?id=1" ||
+		view.Request.Body.Content != "hello" {
+		t.Errorf("streamed request: %+v", view.Request)
+	}
+	if view.Response == nil || view.Response.StatusCode != 201 || view.Response.Body.Content != "ok" {
+		t.Errorf("streamed response: %+v", view.Response)
+	}
+}
+
+func TestInspectorSlowSubscriber(t *testing.T) {
+	ins := newTestInspector(10)
+
+	// a subscriber which is never read doesn't block the collection
+	sub := ins.subscribe(1)
+	defer ins.unsubscribe(sub)
+
+	for i := 1; i <= 3; i++ {
+		publish(t, ins, &HttpTxn{Id: fmt.Sprint(i)})
+	}
+
+	if txn := <-sub; txn.Id != "1" {
+		t.Errorf("subscriber got %s, want the first one", txn.Id)
+	}
+	select {
+	case txn := <-sub:
+		t.Errorf("subscriber got %s beyond its buffer", txn.Id)
+	default:
+	}
+}
+
+func TestBodyView(t *testing.T) {
+	tests := []struct {
+		body      string
+		size      int64
+		content   string
+		encoding  string
+		truncated bool
+	}{
+		{"hello", 5, "hello", "", false},
+		{"", 0, "", "", false},
+		{"\xff\xfe", 2, "//4=", "base64", false},
+		// a rune cut by the capture limit is not binary
+		{"h\xc3\xa9\xc3", 10, "hé", "", true},
+	}
+
+	for _, tt := range tests {
+		v := newBodyView([]byte(tt.body), tt.size)
+		if v.Content != tt.content || v.Encoding != tt.encoding || v.Truncated != tt.truncated || v.Size != tt.size {
+			t.Errorf("newBodyView(%q, %d) = %+v", tt.body, tt.size, v)
+		}
+	}
+}
@@ -3,9 +3,10 @@ package client
 import (
 	"github.com/tianhongw/grp/pkg/conn"
 	"github.com/tianhongw/grp/pkg/message"
+	"github.com/tianhongw/grp/pkg/mux"
 )
 
-func (c *Client) proxy() {
+func (c *Client) proxy(codec message.Codec) {
 	var (
 		remoteConn conn.IConn
 		err        error
@@ -24,6 +25,8 @@ func (c *Client) proxy() {
 
 	defer remoteConn.Close()
 
+	// the proxy registration opens the connection, so it's json framed like
+	// the handshake
 	if err := message.WriteMsg(remoteConn, &message.ProxyReg{
 		ClientId: c.id,
 	}); err != nil {
@@ -31,7 +34,31 @@ func (c *Client) proxy() {
 		return
 	}
 
-	rawMsg, err := message.ReadMsg(remoteConn)
+	c.handleProxy(remoteConn, codec)
+}
+
+// acceptStreams serves the proxy streams opened by the server over a
+// multiplexed control connection.
+func (c *Client) acceptStreams(session *mux.Session, codec message.Codec) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		c.waitGroup.Wrap(func() {
+			remoteConn := conn.WrapConn(stream, "proxy")
+			defer remoteConn.Close()
+
+			c.handleProxy(remoteConn, codec)
+		})
+	}
+}
+
+// handleProxy waits for the server to start the proxy and joins it with a
+// new connection to the local address of the tunnel.
+func (c *Client) handleProxy(remoteConn conn.IConn, codec message.Codec) {
+	rawMsg, err := codec.ReadMsg(remoteConn)
 	if err != nil {
 		c.Errorf("read message failed: %v", err)
 		return
@@ -43,12 +70,17 @@ func (c *Client) proxy() {
 		return
 	}
 
-	tunnel, ok := c.tunnels[startProxy.URL]
+	tunnel, ok := c.getTunnel(startProxy.URL)
 	if !ok {
 		c.Errorf("could not find tunnel for proxy: %s", startProxy.URL)
 		return
 	}
 
+	if tunnel.Protocol == "udp" {
+		c.proxyUDP(remoteConn, tunnel)
+		return
+	}
+
 	locConn, err := conn.Dial(tunnel.LocalAddr, "private", nil)
 	if err != nil {
 		c.Errorf("dial local address: %s failed: %v", tunnel.LocalAddr, err)
@@ -56,14 +88,11 @@ func (c *Client) proxy() {
 	}
 	defer locConn.Close()
 
-	if tunnel.Protocol == "http" ||
-		tunnel.Protocol == "https" {
-		httpWrapper := NewHttpWrapper()
-		wrappedConn := httpWrapper.wrapConn(locConn, nil)
+	if c.httpWrapper != nil && !tunnel.H2C &&
+		(tunnel.Protocol == "http" || tunnel.Protocol == "https") {
+		wrappedConn := c.httpWrapper.wrapConn(locConn, tunnel)
 		_, _ = conn.Join(wrappedConn, remoteConn)
 	} else {
 		_, _ = conn.Join(locConn, remoteConn)
 	}
-
-	return
 }
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+const defaultReplayTimeout = 30 * time.Second
+
+// replayCtx is the connection context of replayed transactions.
+type replayCtx struct {
+	tunnel   *tunnel
+	replayOf string
+}
+
+// replayRequest holds the optional edits applied to a replayed request,
+// a nil field keeps the value of the captured request.
+type replayRequest struct {
+	Method *string      `json:"method"`
+	Path   *string      `json:"path"`
+	Header *http.Header `json:"header"`
+	Body   *string      `json:"body"`
+
+	// "base64" if Body is base64 encoded
+	BodyEncoding string `json:"body_encoding"`
+}
+
+type replayResponse struct {
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code"`
+}
+
+// handleReplay re-sends a captured request by POST /api/txns/{id}/replay,
+// the new transaction is captured like any other one.
+func (ins *inspector) handleReplay(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	txn := ins.getTxn(id)
+	if txn == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no transaction: " + id})
+		return
+	}
+
+	edit := new(replayRequest)
+	if err := json.NewDecoder(r.Body).Decode(edit); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bad replay request: " + err.Error()})
+		return
+	}
+
+	resp, err := ins.replay(txn, edit)
+	if err != nil {
+		ins.lg.Errorf("replay transaction: %s failed: %v", id, err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &replayResponse{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	})
+}
+
+func (ins *inspector) replay(txn *HttpTxn, edit *replayRequest) (*http.Response, error) {
+	t := txnTunnel(txn)
+	if t == nil {
+		return nil, errors.New("no tunnel for the transaction")
+	}
+
+	req, err := newReplayRequest(txn, edit)
+	if err != nil {
+		return nil, err
+	}
+
+	locConn, err := conn.Dial(t.LocalAddr, "private", nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial local address: %s failed: %v", t.LocalAddr, err)
+	}
+
+	// the wrapper captures the replayed request and its response
+	wrappedConn := ins.wrapper.wrapConn(locConn, &replayCtx{tunnel: t, replayOf: txn.Id})
+	defer wrappedConn.Close()
+
+	wrappedConn.SetDeadline(time.Now().Add(defaultReplayTimeout))
+
+	if err := req.Write(wrappedConn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(wrappedConn), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// the response is captured only once it's fully read
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func newReplayRequest(txn *HttpTxn, edit *replayRequest) (*http.Request, error) {
+	orig := txn.Req.Request
+
+	method := orig.Method
+	if edit.Method != nil {
+		method = strings.ToUpper(*edit.Method)
+	}
+
+	path := orig.URL.RequestURI()
+	if edit.Path != nil {
+		path = *edit.Path
+	}
+
+	body := txn.Req.BodyBytes
+	if edit.Body == nil && txn.Req.BodySize > int64(len(body)) {
+		return nil, fmt.Errorf("request body of %d bytes was truncated, replay it with an edited body",
+			txn.Req.BodySize)
+	}
+
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+		if edit.BodyEncoding == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(*edit.Body)
+			if err != nil {
+				return nil, fmt.Errorf("bad base64 body: %v", err)
+			}
+			body = decoded
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://"+orig.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = orig.Header.Clone()
+	if edit.Header != nil {
+		req.Header = edit.Header.Clone()
+	}
+
+	// the body may differ from the captured one
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+
+	// an empty user agent keeps the default one off requests without any
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	// one request per connection
+	req.Close = true
+
+	return req, nil
+}
+
+func txnTunnel(txn *HttpTxn) *tunnel {
+	switch ctx := txn.ConnUserCtx.(type) {
+	case *tunnel:
+		return ctx
+	case *replayCtx:
+		return ctx.tunnel
+	}
+
+	return nil
+}
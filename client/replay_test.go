@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/conf"
+)
+
+const testRawRequest = "POST /api/items?id=1&x=%2F HTTP/1.1\r\n" +
+	"Host: web.nrp.me\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 13\r\n" +
+	"Cookie: a=1; b=2\r\n" +
+	"X-Multi: 1\r\n" +
+	"X-Multi: 2\r\n" +
+	"\r\n" +
+	`{"name":"x"}` + "\n"
+
+// resend writes req to the wire and reads it back as a server would.
+func resend(t *testing.T, req *http.Request) (*http.Request, []byte) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		t.Fatalf("write replay request: %v", err)
+	}
+
+	got, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("read replay request: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(got.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return got, body
+}
+
+func TestNewReplayRequest(t *testing.T) {
+	txn := captureTxn(t, NewHttpWrapper(), testRawRequest, "HTTP/1.1 204 No Content\r\n\r\n")
+
+	orig, err := http.ReadRequest(bufio.NewReader(strings.NewReader(testRawRequest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := newReplayRequest(txn, &replayRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, body := resend(t, req)
+
+	if got.Method != orig.Method || got.RequestURI != orig.RequestURI || got.Host != orig.Host {
+		t.Errorf("replayed %s %s to %s, want %s %s to %s",
+			got.Method, got.RequestURI, got.Host, orig.Method, orig.RequestURI, orig.Host)
+	}
+	if string(body) != `{"name":"x"}`+"\n" || got.ContentLength != int64(len(body)) {
+		t.Errorf("replayed body %q of length %d", body, got.ContentLength)
+	}
+
+	// one request per connection
+	got.Header.Del("Connection")
+	if !reflect.DeepEqual(got.Header, orig.Header) {
+		t.Errorf("replayed header %v, want %v", got.Header, orig.Header)
+	}
+
+	// the captured request is untouched
+	if txn.Req.Header.Get("Content-Length") != "13" {
+		t.Error("the captured header was changed")
+	}
+}
+
+func TestNewReplayRequestEdited(t *testing.T) {
+	txn := captureTxn(t, NewHttpWrapper(), testRawRequest, "HTTP/1.1 204 No Content\r\n\r\n")
+
+	str := func(s string) *string { return &s }
+
+	req, err := newReplayRequest(txn, &replayRequest{
+		Method:       str("put"),
+		Path:         str("/other?y=2"),
+		Header:       &http.Header{"X-Edited": {"1"}, "Content-Length": {"1000"}},
+		Body:         str("AAEC"),
+		BodyEncoding: "base64",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, body := resend(t, req)
+
+	if got.Method != "PUT" || got.RequestURI != "/other?y=2" || got.Host != "web.nrp.me" {
+		t.Errorf("replayed %s %s to %s", got.Method, got.RequestURI, got.Host)
+	}
+	if !bytes.Equal(body, []byte{0, 1, 2}) {
+		t.Errorf("replayed body %q", body)
+	}
+	// the length follows the edited body
+	if got.Header.Get("X-Edited") != "1" || got.Header.Get("Cookie") != "" || got.UserAgent() != "" ||
+		got.ContentLength != 3 {
+		t.Errorf("replayed header %v of length %d", got.Header, got.ContentLength)
+	}
+
+	if _, err := newReplayRequest(txn, &replayRequest{Body: str("!"), BodyEncoding: "base64"}); err == nil {
+		t.Error("bad base64 body: no error")
+	}
+}
+
+func TestNewReplayRequestTruncated(t *testing.T) {
+	txn := captureTxn(t, NewHttpWrapper(), testRawRequest, "HTTP/1.1 204 No Content\r\n\r\n")
+	txn.Req.BodyBytes = txn.Req.BodyBytes[:4]
+
+	if _, err := newReplayRequest(txn, &replayRequest{}); err == nil ||
+		!strings.Contains(err.Error(), "truncated") {
+		t.Errorf("replay of a truncated body: %v", err)
+	}
+
+	body := "full"
+	req, err := newReplayRequest(txn, &replayRequest{Body: &body})
+	if err != nil {
+		t.Fatalf("replay of a truncated body with an edited one: %v", err)
+	}
+	if _, got := resend(t, req); string(got) != body {
+		t.Errorf("replayed body %q", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// conn.Dial logs with the global config
+	cfgFile := filepath.Join(t.TempDir(), "nrp.toml")
+	if err := ioutil.WriteFile(cfgFile, []byte("[log]\ntype = \"std\"\nlevel = \"error\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.Init(cfgFile, "toml"); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *http.Request, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		received <- r
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer local.Close()
+
+	ins := newTestInspector(10)
+	tun := *testTunnel
+	tun.LocalAddr = strings.TrimPrefix(local.URL, "http://")
+
+	orig := captureTxn(t, ins.wrapper, testRawRequest, "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n")
+	orig.ConnUserCtx = &tun
+	publish(t, ins, orig)
+
+	srv := httptest.NewServer(http.HandlerFunc(ins.handleTxn))
+	defer srv.Close()
+
+	// unknown transactions and methods
+	resp, err := http.Post(srv.URL+"/api/txns/nope/replay", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("replay of an unknown transaction: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/txns/" + orig.Id + "/replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET replay: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/api/txns/"+orig.Id+"/replay", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result replayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || result.StatusCode != http.StatusAccepted {
+		t.Errorf("replay: %d, %+v", resp.StatusCode, result)
+	}
+
+	select {
+	case r := <-received:
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || r.RequestURI != "/api/items?id=1&x=%2F" || r.Host != "web.nrp.me" ||
+			r.Header.Get("Cookie") != "a=1; b=2" || string(body) != `{"name":"x"}`+"\n" {
+			t.Errorf("local service received %s %s %v %q", r.Method, r.RequestURI, r.Header, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the local service received no request")
+	}
+
+	// the replay is captured as a transaction of its own
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var replayed *HttpTxn
+		for _, txn := range ins.getTxns() {
+			if ctx, ok := txn.ConnUserCtx.(*replayCtx); ok && ctx.replayOf == orig.Id {
+				replayed = txn
+			}
+		}
+		if replayed != nil {
+			if view := newTxnView(replayed); view.ReplayOf != orig.Id || view.Tunnel != tun.PublicUrl {
+				t.Errorf("replayed transaction: %+v", view)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the replay was not captured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
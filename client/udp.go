@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"net"
+
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+// proxyUDP relays the framed datagrams of one remote address between the
+// proxy connection and the local address of the tunnel, the server closes
+// the proxy once the session is idle.
+func (c *Client) proxyUDP(remoteConn conn.IConn, t *tunnel) {
+	locAddr, err := net.ResolveUDPAddr("udp", t.LocalAddr)
+	if err != nil {
+		c.Errorf("resolve local address: %s failed: %v", t.LocalAddr, err)
+		return
+	}
+
+	locConn, err := net.DialUDP("udp", nil, locAddr)
+	if err != nil {
+		c.Errorf("dial local address: %s failed: %v", t.LocalAddr, err)
+		return
+	}
+	defer locConn.Close()
+
+	go func() {
+		defer remoteConn.Close()
+
+		buf := make([]byte, conn.MaxDatagramSize)
+		for {
+			n, err := locConn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// e.g. refused while the local service is down, keep going
+				c.Debugf("read from local address: %s failed: %v", t.LocalAddr, err)
+				continue
+			}
+
+			if err := conn.WriteDatagram(remoteConn, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, conn.MaxDatagramSize)
+	for {
+		n, err := conn.ReadDatagram(remoteConn, buf)
+		if err != nil {
+			return
+		}
+
+		if _, err := locConn.Write(buf[:n]); err != nil {
+			c.Debugf("write to local address: %s failed: %v", t.LocalAddr, err)
+		}
+	}
+}
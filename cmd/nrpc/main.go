@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
@@ -24,6 +25,8 @@ const (
 var (
 	cfgFile string
 	cfgType string
+	harFile string
+	watch   bool
 )
 
 func NewCommand() *cobra.Command {
@@ -59,6 +62,9 @@ Build time: %s`,
 	flags.StringVarP(&cfgFile, "config", "c", "", fmt.Sprintf("Config file (default is %s)", defaultCfgFile))
 	flags.StringVarP(&cfgType, "type", "t", "", fmt.Sprintf("Config file type (default is %s)", defaultCfgType))
 
+	flags.StringVar(&harFile, "har", "", "Write captured http transactions to this HAR file")
+	flags.BoolVarP(&watch, "watch", "w", false, "Reload the config file whenever it changes, it's also reloaded on SIGHUP")
+
 	util.AddProfilingFlags(flags)
 
 	return cmd
@@ -111,12 +117,18 @@ func serve() {
 func (p *program) Init(env svc.Environment) error {
 	cfg := conf.GetConfig()
 
+	if harFile != "" {
+		cfg.Client.HAROutput = harFile
+	}
+
 	p.nrpc = client.NewClient(cfg)
 
 	return nil
 }
 
 func (p *program) Start() error {
+	p.watchReload()
+
 	if err := p.nrpc.Run(); err != nil {
 		log.Println(err)
 		p.Stop()
@@ -126,6 +138,33 @@ func (p *program) Start() error {
 	return nil
 }
 
+// watchReload reloads the config on SIGHUP, and whenever the config file
+// changes with --watch.
+func (p *program) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			p.reload()
+		}
+	}()
+
+	if watch {
+		conf.Watch(p.reload)
+	}
+}
+
+func (p *program) reload() {
+	cfg, err := conf.Reload()
+	if err != nil {
+		log.Println("reload config failed, ", err)
+		return
+	}
+
+	p.nrpc.Reload(cfg)
+}
+
 func (p *program) Stop() error {
 	p.once.Do(func() {
 		p.nrpc.Exit()
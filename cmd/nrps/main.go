@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
@@ -24,6 +25,7 @@ const (
 var (
 	cfgFile string
 	cfgType string
+	watch   bool
 )
 
 func newCommand() *cobra.Command {
@@ -58,6 +60,7 @@ Build time: %s`,
 
 	flags.StringVarP(&cfgFile, "config", "c", "", fmt.Sprintf("Config file (default is %s)", defaultCfgFile))
 	flags.StringVarP(&cfgType, "type", "t", "", fmt.Sprintf("Config file type (default is %s)", defaultCfgType))
+	flags.BoolVarP(&watch, "watch", "w", false, "Reload the config file whenever it changes, it's also reloaded on SIGHUP")
 
 	util.AddProfilingFlags(flags)
 
@@ -124,9 +127,40 @@ func (p *program) Start() error {
 		os.Exit(1)
 	}
 
+	p.watchReload()
+
 	return nil
 }
 
+// watchReload reloads the config on SIGHUP, and whenever the config file
+// changes with --watch.
+func (p *program) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			p.reload()
+		}
+	}()
+
+	if watch {
+		conf.Watch(p.reload)
+	}
+}
+
+func (p *program) reload() {
+	cfg, err := conf.Reload()
+	if err != nil {
+		log.Println("reload config failed, ", err)
+		return
+	}
+
+	if err := p.nrps.Reload(cfg); err != nil {
+		log.Println("reload config failed, ", err)
+	}
+}
+
 func (p *program) Stop() error {
 	p.once.Do(func() {
 		p.nrps.Exit()
@@ -1,13 +1,26 @@
 package conf
 
 import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
-var gConfig *Config
+var (
+	// holds the *Config, replaced as a whole on reload
+	gConfig atomic.Value
+
+	// reads the config file given to Init, guarded by mu on reload
+	gViper *viper.Viper
+	mu     sync.Mutex
+)
 
+// GetConfig returns the current config, nil before Init.
 func GetConfig() *Config {
-	return gConfig
+	c, _ := gConfig.Load().(*Config)
+	return c
 }
 
 type Config struct {
@@ -23,6 +36,9 @@ type ServerOption struct {
 	// public addr for HTTPS connections
 	HTTPSAddr string `mapstructure:"https_addr"`
 
+	// public addr for tls passthrough connections, routed by sni
+	TLSAddr string `mapstructure:"tls_addr"`
+
 	// public port listening for nrp client
 	ClientAddr string `mapstructure:"client_addr"`
 
@@ -35,18 +51,141 @@ type ServerOption struct {
 	// path to the tls key file
 	TLSKey string `mapstructure:"tls_key"`
 
+	// serve tls for nrp client on client addr with tls_crt and tls_key
+	ClientTLS bool `mapstructure:"client_tls"`
+
+	// path to the ca bundle to verify nrp client certificates
+	ClientCA string `mapstructure:"client_ca"`
+
+	// reject nrp clients without a certificate signed by client_ca
+	RequireClientCert bool `mapstructure:"require_client_cert"`
+
 	// timeout in sec for connection write
 	ConnWriteTimeoutSec int `mapstructure:"conn_write_timeout_sec"`
 
 	// timeout in sec for connection read
 	ConnReadTimeoutSec int `mapstructure:"conn_read_timeout_sec"`
+
+	// clients speaking an older protocol version are rejected
+	MinProtocolVersion int `mapstructure:"min_protocol_version"`
+
+	// udp sessions without traffic for this long are closed
+	UDPIdleTimeoutSec int `mapstructure:"udp_idle_timeout_sec"`
+
+	// max number of udp sessions per tunnel, datagrams from new remote
+	// addresses are dropped beyond it
+	UDPMaxSessions int `mapstructure:"udp_max_sessions"`
+
+	// on shutdown, time in sec given to the proxied connections to finish
+	// before they are closed
+	DrainTimeoutSec int `mapstructure:"drain_timeout_sec"`
+
+	// time in sec the tunnels of a disconnected client are held for it to
+	// reconnect and get the same urls back, disabled if 0
+	ResumeGraceSec int `mapstructure:"resume_grace_sec"`
+
+	// authentication for nrp clients, no authentication if empty
+	Auth *AuthOption `mapstructure:"auth"`
+
+	// addr of the admin api, disabled if empty
+	AdminAddr string `mapstructure:"admin_addr"`
+
+	// bearer token required by the admin api
+	AdminToken string `mapstructure:"admin_token"`
+
+	// addr serving prometheus metrics on /metrics, disabled if empty
+	MetricsAddr string `mapstructure:"metrics_addr"`
+
+	// path of the json file keeping the sub domains, host names and ports
+	// reserved for users, reservations are disabled if empty
+	ReservationsFile string `mapstructure:"reservations_file"`
+
+	// tunnel policies per user, users without a policy are not restricted
+	Policies []*PolicyOption `mapstructure:"policies"`
+}
+
+type PolicyOption struct {
+	// users the policy applies to, "*" matches users without their own policy
+	Users []string `mapstructure:"users"`
+
+	// patterns of sub domains allowed to claim, e.g. "team-*", any if empty
+	SubDomains []string `mapstructure:"sub_domains"`
+
+	// patterns of host names allowed to claim, e.g. "*.team.com", any if empty,
+	// or none outside the domain if sub_domains is set
+	HostNames []string `mapstructure:"host_names"`
+
+	// remote ports or port ranges allowed to bind, e.g. "8080" or "10000-10100", any if empty
+	Ports []string `mapstructure:"ports"`
+
+	// protocols allowed to use, any if empty
+	Protocols []string `mapstructure:"protocols"`
+
+	// max number of tunnels per user over all its clients, unlimited if 0
+	MaxTunnels int `mapstructure:"max_tunnels"`
+}
+
+type AuthOption struct {
+	// one of none|token|htpasswd|http
+	Type string `mapstructure:"type"`
+
+	// tokens accepted by the token authenticator
+	Tokens []*TokenOption `mapstructure:"tokens"`
+
+	// path to the htpasswd file, bcrypt, sha1 and plain passwords are supported
+	HtpasswdFile string `mapstructure:"htpasswd_file"`
+
+	// url of the auth service called by the http authenticator
+	URL string `mapstructure:"url"`
+
+	// timeout in sec for calling the auth service
+	TimeoutSec int `mapstructure:"timeout_sec"`
+}
+
+type TokenOption struct {
+	Token string `mapstructure:"token"`
+	// user the token authenticates as, required
+	User string `mapstructure:"user"`
 }
 
 type ClientOption struct {
 	ServerAddr string                   `mapstructure:"server_addr"`
 	HTTPProxy  string                   `mapstructure:"http_proxy"`
 	AuthToken  string                   `mapstructure:"auth_token"`
+	User       string                   `mapstructure:"user"`
+	Password   string                   `mapstructure:"password"`
 	Tunnels    map[string]*TunnelOption `mapstructure:"tunnels"`
+
+	// connect to the server over tls
+	TLS bool `mapstructure:"tls"`
+
+	// path to the ca bundle to verify the server, system roots if empty
+	TLSCA string `mapstructure:"tls_ca"`
+
+	// server name to verify the server, host of server_addr if empty
+	TLSServerName string `mapstructure:"tls_server_name"`
+
+	// addr of the local web dashboard inspecting http tunnels, disabled if empty
+	InspectAddr string `mapstructure:"inspect_addr"`
+
+	// skip verifying the server certificate, testing only
+	TLSInsecureSkipVerify bool `mapstructure:"tls_insecure_skip_verify"`
+
+	// path to the client certificate file presented to the server
+	TLSCrt string `mapstructure:"tls_crt"`
+
+	// path to the client key file
+	TLSKey string `mapstructure:"tls_key"`
+
+	// path of the har file kept up to date with captured http transactions
+	HAROutput string `mapstructure:"har_output"`
+
+	// max number of http transactions kept in memory for inspection
+	MaxInspectTxns int `mapstructure:"max_inspect_txns"`
+
+	// multiplex proxy streams over the control connection instead of
+	// dialing a new connection for every public connection
+	Mux bool `mapstructure:"mux"`
 }
 
 type TunnelOption struct {
@@ -54,8 +193,42 @@ type TunnelOption struct {
 	SubDomain string            `mapstructure:"sub_domain"`
 	Protocols map[string]string `mapstructure:"protocols"`
 	HttpAuth  string            `mapstructure:"http_auth"`
-	// remote tcp port ask for
+	// remote tcp or udp port ask for
 	RemotePort int `mapstructure:"remote_port"`
+
+	// http only, claim only the requests below this path on the host, the other
+	// paths of the host stay with the tunnels of the same user
+	PathPrefix string `mapstructure:"path_prefix"`
+
+	// remove the path prefix before forwarding the requests
+	StripPrefix bool `mapstructure:"strip_prefix"`
+
+	// share the url with the clients of the same user joining the group
+	Group string `mapstructure:"group"`
+
+	// round-robin, least-conn or random, round-robin if empty
+	Balance string `mapstructure:"balance"`
+
+	// http only, set X-Forwarded-Proto and X-Forwarded-Host, X-Forwarded-For
+	// is always set unless removed or overridden by the rules below
+	XForwarded bool `mapstructure:"x_forwarded"`
+
+	// http only, headers removed from every request
+	RemoveHeaders []string `mapstructure:"remove_headers"`
+
+	// http only, headers replaced in every request, not the Host
+	SetHeaders map[string]string `mapstructure:"set_headers"`
+
+	// http only, headers added to every request, not the Host
+	AddHeaders map[string]string `mapstructure:"add_headers"`
+
+	// http only, replaces the Host of every request, e.g. the host name the
+	// local service expects
+	HostHeader string `mapstructure:"host_header"`
+
+	// http only, the local service speaks http/2 over cleartext, the
+	// requests are forwarded to it as h2c instead of http/1.1
+	H2C bool `mapstructure:"h2c"`
 }
 
 type LogOption struct {
@@ -82,7 +255,41 @@ func Init(cfgFile, cfgType string) (string, error) {
 		return "", err
 	}
 
-	gConfig = c
+	gConfig.Store(c)
+	gViper = v
 
 	return v.ConfigFileUsed(), nil
 }
+
+// Reload reads the config file given to Init again. The new config replaces
+// the global one, the config returned before is left untouched as it may
+// still be in use.
+func Reload() (*Config, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := gViper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	c := new(Config)
+
+	if err := gViper.Unmarshal(c); err != nil {
+		return nil, err
+	}
+
+	gConfig.Store(c)
+
+	return c, nil
+}
+
+// Watch calls onChange whenever the config file given to Init is written.
+func Watch(onChange func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	gViper.OnConfigChange(func(fsnotify.Event) {
+		onChange()
+	})
+	gViper.WatchConfig()
+}
@@ -0,0 +1,58 @@
+package conf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nrp.toml")
+	if err := ioutil.WriteFile(file, []byte("[server]\ndomain = \"a.me\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Init(file, "toml"); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	old := GetConfig()
+	if old.Server.Domain != "a.me" {
+		t.Fatalf("domain: %s", old.Server.Domain)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("[server]\ndomain = \"b.me\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// readers run concurrently with the reload, go test -race checks them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if c := GetConfig(); c == nil || c.Server == nil {
+					t.Error("no config")
+					return
+				}
+			}
+		}()
+	}
+
+	c, err := Reload()
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if c.Server.Domain != "b.me" || GetConfig() != c {
+		t.Errorf("reloaded config not current: %s", GetConfig().Server.Domain)
+	}
+
+	// the config handed out before stays as it was
+	if old.Server.Domain != "a.me" {
+		t.Errorf("old config changed: %s", old.Server.Domain)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	stdlog "log"
@@ -39,6 +40,22 @@ func (c *loggedConn) StartTLS(tlsCfg *tls.Config) {
 	c.Conn = tls.Client(c.Conn, tlsCfg)
 }
 
+// Handshake runs the tls handshake of a connection accepted by a tls
+// listener and returns the application protocol negotiated with ALPN. It
+// does nothing for plain connections.
+func (c *loggedConn) Handshake() (string, error) {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	return tlsConn.ConnectionState().NegotiatedProtocol, nil
+}
+
 func (c *loggedConn) SetType(typ string) {
 	c.typ = typ
 }
@@ -50,6 +67,14 @@ func (c *loggedConn) Close() error {
 type Listener struct {
 	net.Addr
 	Conns chan *loggedConn
+
+	l net.Listener
+}
+
+// Close stops accepting connections, Conns is closed once the accepting
+// goroutine is done.
+func (l *Listener) Close() error {
+	return l.l.Close()
 }
 
 func WrapConn(conn net.Conn, typ string) *loggedConn {
@@ -63,9 +88,17 @@ func WrapConn(conn net.Conn, typ string) *loggedConn {
 			id:     wrapped.id,
 			typ:    wrapped.typ,
 		}
+	case *vhost.TLSConn:
+		wrapped := c.Conn.(*loggedConn)
+		return &loggedConn{
+			Conn:   conn,
+			Logger: wrapped.Logger,
+			id:     wrapped.id,
+			typ:    wrapped.typ,
+		}
 	case *loggedConn:
 		return c
-	case *net.TCPConn:
+	default:
 		id := util.NewIntID()
 		lg, _ := log.NewLogger(cfg.Log.Type,
 			log.WithLevel(cfg.Log.Level), log.WithPrefix(fmt.Sprint(id, "-")))
@@ -77,8 +110,6 @@ func WrapConn(conn net.Conn, typ string) *loggedConn {
 		}
 		return wrapped
 	}
-
-	panic("unsupported connection type")
 }
 
 func Listen(addr, typ string, tlsCfg *tls.Config) (*Listener, error) {
@@ -90,12 +121,17 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (*Listener, error) {
 	l := &Listener{
 		Addr:  listener.Addr(),
 		Conns: make(chan *loggedConn),
+		l:     listener,
 	}
 
 	go func() {
 		for {
 			rawConn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					close(l.Conns)
+					return
+				}
 				stdlog.Printf("accept new tcp connection failed: %v", err)
 				continue
 			}
@@ -212,12 +248,12 @@ func DialHttpProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (*loggedConn,
 	case "http":
 		// do nothin
 	case "https":
-		proxyTlsCfg = &tls.Config{}
+		proxyTlsCfg = &tls.Config{ServerName: u.Hostname()}
 	default:
 		return nil, fmt.Errorf("unsupported proxy url schema: %s", u.Scheme)
 	}
 
-	conn, err := Dial(addr, typ, proxyTlsCfg)
+	conn, err := Dial(u.Host, typ, proxyTlsCfg)
 	if err != nil {
 		return nil, err
 	}
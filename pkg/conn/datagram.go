@@ -0,0 +1,42 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the biggest udp payload, datagrams are framed with a
+// 2 bytes big endian length when relayed over a stream.
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes b as a single frame.
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// ReadDatagram reads a frame into buf, which must hold MaxDatagramSize bytes.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r, buf[:binary.BigEndian.Uint16(size[:])])
+	if err == io.EOF {
+		// the stream ended within the frame
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,69 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	datagrams := [][]byte{
+		[]byte("ping"),
+		{},
+		bytes.Repeat([]byte{0xab}, 1500),
+		bytes.Repeat([]byte{0xcd}, MaxDatagramSize),
+	}
+
+	var stream bytes.Buffer
+	for _, b := range datagrams {
+		if err := WriteDatagram(&stream, b); err != nil {
+			t.Fatalf("write %d bytes: %v", len(b), err)
+		}
+	}
+
+	if want := 4*2 + 4 + 1500 + MaxDatagramSize; stream.Len() != want {
+		t.Errorf("stream of %d bytes, want %d", stream.Len(), want)
+	}
+	if frame := stream.Bytes()[:6]; !bytes.Equal(frame, []byte{0, 4, 'p', 'i', 'n', 'g'}) {
+		t.Errorf("frame: %v", frame)
+	}
+
+	// datagrams keep their boundaries on the stream
+	buf := make([]byte, MaxDatagramSize)
+	for _, want := range datagrams {
+		n, err := ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("read %d bytes, want %d", n, len(want))
+		}
+	}
+
+	if _, err := ReadDatagram(&stream, buf); err != io.EOF {
+		t.Errorf("read of an empty stream: %v", err)
+	}
+}
+
+func TestDatagramTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteDatagram(&stream, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Error("oversized datagram: no error")
+	}
+	if stream.Len() != 0 {
+		t.Errorf("%d bytes written of an oversized datagram", stream.Len())
+	}
+}
+
+func TestDatagramTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	WriteDatagram(&stream, []byte("ping"))
+	frame := stream.Bytes()
+
+	buf := make([]byte, MaxDatagramSize)
+	for i := 1; i < len(frame); i++ {
+		if _, err := ReadDatagram(bytes.NewReader(frame[:i]), buf); err != io.ErrUnexpectedEOF {
+			t.Errorf("frame truncated to %d bytes: %v", i, err)
+		}
+	}
+}
@@ -32,6 +32,8 @@ type Tee struct {
 		rd *io.PipeReader
 		wr *io.PipeWriter
 	}
+	readBuf  *bufio.Reader
+	writeBuf *bufio.Reader
 	IConn
 }
 
@@ -47,15 +49,20 @@ func NewTee(conn IConn) *Tee {
 
 	c.rd = io.TeeReader(c.IConn, c.readPipe.wr)
 	c.wr = io.MultiWriter(c.IConn, c.writePipe.wr)
+
+	// the buffers are shared by all consumers, a new reader per call
+	// would lose the bytes already buffered by the previous one
+	c.readBuf = bufio.NewReader(c.readPipe.rd)
+	c.writeBuf = bufio.NewReader(c.writePipe.rd)
 	return c
 }
 
 func (c *Tee) ReadBuffer() *bufio.Reader {
-	return bufio.NewReader(c.readPipe.rd)
+	return c.readBuf
 }
 
 func (c *Tee) WriteBuffer() *bufio.Reader {
-	return bufio.NewReader(c.writePipe.rd)
+	return c.writeBuf
 }
 
 func (c *Tee) Read(b []byte) (n int, err error) {
@@ -81,3 +88,9 @@ func (c *Tee) Write(b []byte) (n int, err error) {
 	}
 	return
 }
+
+func (c *Tee) Close() error {
+	c.readPipe.wr.Close()
+	c.writePipe.wr.Close()
+	return c.IConn.Close()
+}
@@ -0,0 +1,90 @@
+package conn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+func LoadServerTLSConfig(crtFile, keyFile string) (*tls.Config, error) {
+	if crtFile == "" || keyFile == "" {
+		return nil, errors.New("both tls certificate and key file are required")
+	}
+
+	crt, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{crt},
+	}, nil
+}
+
+func LoadClientTLSConfig(caFile, crtFile, keyFile, serverName string,
+	insecureSkipVerify bool) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if crtFile != "" || keyFile != "" {
+		crt, err := tls.LoadX509KeyPair(crtFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{crt}
+	}
+
+	return tlsCfg, nil
+}
+
+// PeerIdentity returns the subject of the verified peer certificate,
+// or an empty string if the peer did not present one.
+func PeerIdentity(c IConn) string {
+	lc, ok := c.(*loggedConn)
+	if !ok {
+		return ""
+	}
+
+	tlsConn, ok := lc.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+
+	return subject.String()
+}
+
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in: %s", caFile)
+	}
+
+	return pool, nil
+}
@@ -2,8 +2,10 @@ package log
 
 import (
 	"errors"
+	"math"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 type Level int
@@ -72,26 +74,48 @@ type Logger interface {
 
 func WithLevel(levelText string) Option {
 	return func(o *options) {
-		var level Level
-		switch strings.ToLower(levelText) {
-		case "debug":
-			level = LevelDebug
-		case "info", "":
-			level = LevelInfo
-		case "warning", "warn":
-			level = LevelWarning
-		case "error", "err":
-			level = LevelError
-		case "fatal":
-			level = LevelFatal
-		default:
-			level = LevelInfo
-		}
+		o.Level = ParseLevel(levelText)
+	}
+}
 
-		o.Level = level
+// ParseLevel returns the level named by levelText, info if unknown.
+func ParseLevel(levelText string) Level {
+	switch strings.ToLower(levelText) {
+	case "debug":
+		return LevelDebug
+	case "info", "":
+		return LevelInfo
+	case "warning", "warn":
+		return LevelWarning
+	case "error", "err":
+		return LevelError
+	case "fatal":
+		return LevelFatal
+	default:
+		return LevelInfo
 	}
 }
 
+// unset until SetGlobalLevel is called
+const noGlobalLevel = math.MinInt32
+
+var globalLevel int32 = noGlobalLevel
+
+// SetGlobalLevel overrides the level of every logger, including the ones
+// already created, so a reloaded config applies to long living loggers.
+func SetGlobalLevel(l Level) {
+	atomic.StoreInt32(&globalLevel, int32(l))
+}
+
+// effectiveLevel is the global level if set, or the level of the logger.
+func effectiveLevel(own Level) Level {
+	if l := atomic.LoadInt32(&globalLevel); l != noGlobalLevel {
+		return Level(l)
+	}
+
+	return own
+}
+
 func WithFormat(formatText string) Option {
 	return func(o *options) {
 		var format Format
@@ -122,7 +122,7 @@ func (l *StdLogger) Level() Level {
 	l.mu.RLock()
 	v := l.logLevel
 	l.mu.RUnlock()
-	return v
+	return effectiveLevel(v)
 }
 
 func (l *StdLogger) SetLevel(level Level) {
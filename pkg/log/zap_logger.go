@@ -6,6 +6,7 @@ import (
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,11 +39,18 @@ func NewZapLogger(opt *options) *ZapLogger {
 		zapEncoder = zapcore.NewConsoleEncoder(encoderCfg)
 	}
 
+	enabled := func(lvl zapcore.Level) bool {
+		if l := atomic.LoadInt32(&globalLevel); l != noGlobalLevel {
+			return lvl >= zapcore.Level(l)
+		}
+		return zapLevel.Enabled(lvl)
+	}
+
 	highPriority := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return zapLevel.Enabled(lvl) && lvl >= zapcore.ErrorLevel
+		return enabled(lvl) && lvl >= zapcore.ErrorLevel
 	})
 	lowPriority := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return zapLevel.Enabled(lvl) && lvl < zapcore.ErrorLevel
+		return enabled(lvl) && lvl < zapcore.ErrorLevel
 	})
 
 	var cores []zapcore.Core
@@ -162,20 +170,23 @@ func (logging *ZapLogger) Fatalln(args ...interface{}) {
 func (logging *ZapLogger) Level() Level {
 	zapLevel := logging.level.Level()
 
+	var l Level
 	switch zapLevel {
 	case zap.DebugLevel:
-		return LevelDebug
+		l = LevelDebug
 	case zap.InfoLevel:
-		return LevelInfo
+		l = LevelInfo
 	case zap.WarnLevel:
-		return LevelWarning
+		l = LevelWarning
 	case zap.ErrorLevel:
-		return LevelError
+		l = LevelError
 	case zap.PanicLevel, zap.DPanicLevel, zap.FatalLevel:
-		return LevelFatal
+		l = LevelFatal
 	default:
-		return LevelInfo
+		l = LevelInfo
 	}
+
+	return effectiveLevel(l)
 }
 
 func (logging *ZapLogger) SetLevel(l Level) {
@@ -0,0 +1,368 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+// binary frames are a type byte, the uvarint length of the payload and the
+// payload, which holds the exported fields of the message in declaration
+// order: strings and byte slices are length prefixed, integers are varints,
+// bools a single byte.
+type binaryCodec struct{}
+
+// binaryTypes assigns the type byte of every message, the position in the
+// list is the type byte so new messages must be appended.
+var binaryTypes = []Message{
+	(*AuthRequest)(nil),
+	(*AuthResponse)(nil),
+	(*TunnelRequest)(nil),
+	(*TunnelResponse)(nil),
+	(*ProxyRequest)(nil),
+	(*ProxyReg)(nil),
+	(*ProxyStart)(nil),
+	(*Ping)(nil),
+	(*Pong)(nil),
+	(*Drain)(nil),
+	(*TunnelClose)(nil),
+}
+
+var binaryTypeIds = make(map[reflect.Type]byte)
+
+func init() {
+	for i, msg := range binaryTypes {
+		binaryTypeIds[reflect.TypeOf(msg).Elem()] = byte(i)
+	}
+}
+
+var errShortPayload = errors.New("payload too short")
+
+func (binaryCodec) Name() string {
+	return CodecBinary
+}
+
+func (binaryCodec) ReadMsg(c conn.IConn) (Message, error) {
+	// read the header byte by byte, anything after the frame belongs to
+	// whoever reads the connection next
+	r := &byteReader{r: c}
+
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if int(typ) >= len(binaryTypes) {
+		return nil, fmt.Errorf("unsupported message type: %d", typ)
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > MaxMsgSize {
+		return nil, fmt.Errorf("message size: %d out of range", size)
+	}
+
+	buf := make([]byte, size)
+	if n, err := io.ReadFull(c, buf); err != nil {
+		return nil, fmt.Errorf("expected: %d bytes, but got: %d bytes: %v", size, n, err)
+	}
+
+	msg := reflect.New(reflect.TypeOf(binaryTypes[typ]).Elem())
+
+	d := &decoder{buf: buf}
+	if err := d.decode(msg.Elem()); err != nil {
+		return nil, fmt.Errorf("decode %s failed: %v", msg.Elem().Type().Name(), err)
+	}
+
+	if len(d.buf) != 0 {
+		return nil, fmt.Errorf("decode %s failed: %d trailing bytes", msg.Elem().Type().Name(), len(d.buf))
+	}
+
+	return msg.Interface(), nil
+}
+
+func (binaryCodec) WriteMsg(c conn.IConn, msg Message) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("message: %T is not a pointer", msg)
+	}
+
+	typ, ok := binaryTypeIds[v.Type().Elem()]
+	if !ok {
+		return fmt.Errorf("unsupported message type: %T", msg)
+	}
+
+	var payload bytes.Buffer
+	if err := encode(&payload, v.Elem()); err != nil {
+		return err
+	}
+
+	if payload.Len() > MaxMsgSize {
+		return fmt.Errorf("message size: %d out of range", payload.Len())
+	}
+
+	frame := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+payload.Len())
+	frame[0] = typ
+	n := binary.PutUvarint(frame[1:], uint64(payload.Len()))
+	frame = append(frame[:1+n], payload.Bytes()...)
+
+	// a single write keeps the frame in one piece on shared connections
+	_, err := c.Write(frame)
+
+	return err
+}
+
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return 0, err
+	}
+
+	return r.buf[0], nil
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	var tmp [binary.MaxVarintLen64]byte
+
+	putUvarint := func(x uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], x)])
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		putUvarint(uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.Write(tmp[:binary.PutVarint(tmp[:], v.Int())])
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		putUvarint(v.Uint())
+	case reflect.Slice:
+		putUvarint(uint64(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type: %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		putUvarint(uint64(len(keys)))
+		for _, k := range keys {
+			if err := encode(buf, k); err != nil {
+				return err
+			}
+			if err := encode(buf, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return nil
+		}
+		buf.WriteByte(1)
+		return encode(buf, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := encode(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+
+	return nil
+}
+
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errShortPayload
+	}
+	d.buf = d.buf[n:]
+
+	return x, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		return 0, errShortPayload
+	}
+	d.buf = d.buf[n:]
+
+	return x, nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	if len(d.buf) < 1 {
+		return 0, errShortPayload
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+
+	return b, nil
+}
+
+// length reads a length prefix, every element takes at least one byte so
+// a length beyond the rest of the payload can only be garbage.
+func (d *decoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+
+	if n > uint64(len(d.buf)) {
+		return 0, errShortPayload
+	}
+
+	return int(n), nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return b, nil
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Bool:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := d.varint()
+		if err != nil {
+			return err
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type: %s", v.Type().Key())
+		}
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(k); err != nil {
+				return err
+			}
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(e); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, e)
+		}
+		v.Set(m)
+	case reflect.Ptr:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		if b == 0 {
+			return nil
+		}
+		e := reflect.New(v.Type().Elem())
+		if err := d.decode(e.Elem()); err != nil {
+			return err
+		}
+		v.Set(e)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+
+	return nil
+}
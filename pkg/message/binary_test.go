@@ -0,0 +1,299 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tianhongw/grp/pkg/log"
+)
+
+// bufConn is a conn.IConn reading what was written to it.
+type bufConn struct {
+	net.Conn
+	log.DumbLogger
+
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)  { return c.buf.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *bufConn) SetType(string)              {}
+
+func newBufConn(b []byte) *bufConn {
+	c := new(bufConn)
+	c.buf.Write(b)
+
+	return c
+}
+
+// binarySamples holds a message of every type with all fields set.
+var binarySamples = []Message{
+	&AuthRequest{
+		User:          "alice",
+		Password:      "secret",
+		Token:         "t0ken",
+		ClientId:      "c1",
+		Version:       8,
+		ClientVersion: "1.2.3",
+		Capabilities:  []string{"codec:binary/1", "codec:json"},
+		ResumeToken:   "r3sume",
+	},
+	&AuthResponse{
+		ClientId:      "c1",
+		ErrorMsg:      "denied",
+		Version:       -1,
+		ServerVersion: "1.2.3",
+		Capabilities:  []string{"codec:binary/1"},
+		ResumeToken:   "r3sume",
+	},
+	&TunnelRequest{
+		RequestId:     "req",
+		Protocol:      "http",
+		HostName:      "example.com",
+		SubDomain:     "sub",
+		HttpAuth:      "Basic dXNlcjpwYXNz",
+		RemotePort:    65535,
+		PathPrefix:    "/api",
+		StripPrefix:   true,
+		Group:         "g",
+		Balance:       "round_robin",
+		XForwarded:    true,
+		RemoveHeaders: []string{"Cookie"},
+		SetHeaders:    map[string]string{"X-A": "1", "X-B": "ünïcode"},
+		AddHeaders:    map[string]string{"X-C": ""},
+		HostHeader:    "localhost",
+		H2C:           true,
+	},
+	&TunnelResponse{
+		RequestId: "req",
+		URL:       "http://sub.nrp.me",
+		Protocol:  "http",
+		ErrorMsg:  "",
+	},
+	&ProxyRequest{},
+	&ProxyReg{ClientId: "c1"},
+	&ProxyStart{URL: "tcp://nrp.me:12345", ClientAddr: "10.0.0.1:4242"},
+	&Ping{},
+	&Pong{},
+	&Drain{DeadlineSec: 30},
+	&TunnelClose{URL: "http://sub.nrp.me"},
+}
+
+func encodeFrame(t *testing.T, msg Message) []byte {
+	t.Helper()
+
+	c := new(bufConn)
+	if err := (binaryCodec{}).WriteMsg(c, msg); err != nil {
+		t.Fatalf("write %T: %v", msg, err)
+	}
+
+	return c.buf.Bytes()
+}
+
+func TestBinarySamplesCoverTypes(t *testing.T) {
+	if len(binarySamples) != len(binaryTypes) {
+		t.Fatalf("%d samples for %d message types", len(binarySamples), len(binaryTypes))
+	}
+
+	for i, msg := range binarySamples {
+		if reflect.TypeOf(msg) != reflect.TypeOf(binaryTypes[i]) {
+			t.Errorf("sample %d is %T, want %T", i, msg, binaryTypes[i])
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, msg := range binarySamples {
+		frame := encodeFrame(t, msg)
+
+		if frame[0] != binaryTypeIds[reflect.TypeOf(msg).Elem()] {
+			t.Errorf("%T: type byte %d", msg, frame[0])
+		}
+
+		got, err := (binaryCodec{}).ReadMsg(newBufConn(frame))
+		if err != nil {
+			t.Errorf("read %T: %v", msg, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("round trip of %T:\n got %+v\nwant %+v", msg, got, msg)
+		}
+	}
+}
+
+func TestBinaryZeroValues(t *testing.T) {
+	for _, sample := range binarySamples {
+		msg := reflect.New(reflect.TypeOf(sample).Elem()).Interface()
+
+		got, err := (binaryCodec{}).ReadMsg(newBufConn(encodeFrame(t, msg)))
+		if err != nil {
+			t.Errorf("read %T: %v", msg, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("round trip of %T:\n got %+v\nwant %+v", msg, got, msg)
+		}
+	}
+}
+
+func TestBinaryConsecutiveFrames(t *testing.T) {
+	c := new(bufConn)
+	for _, msg := range binarySamples {
+		if err := (binaryCodec{}).WriteMsg(c, msg); err != nil {
+			t.Fatalf("write %T: %v", msg, err)
+		}
+	}
+
+	// a frame is read without consuming the next one
+	for _, want := range binarySamples {
+		got, err := (binaryCodec{}).ReadMsg(c)
+		if err != nil {
+			t.Fatalf("read %T: %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	if c.buf.Len() != 0 {
+		t.Errorf("%d bytes left", c.buf.Len())
+	}
+}
+
+func TestBinaryTruncatedFrame(t *testing.T) {
+	for _, msg := range binarySamples {
+		frame := encodeFrame(t, msg)
+
+		for i := 0; i < len(frame); i++ {
+			if _, err := (binaryCodec{}).ReadMsg(newBufConn(frame[:i])); err == nil {
+				t.Errorf("%T truncated to %d of %d bytes: no error", msg, i, len(frame))
+			}
+		}
+	}
+}
+
+func TestBinaryTruncatedPayload(t *testing.T) {
+	for _, msg := range binarySamples {
+		frame := encodeFrame(t, msg)
+
+		_, n := binary.Uvarint(frame[1:])
+		payload := frame[1+n:]
+
+		// the frame is complete, but the payload misses the last fields
+		for i := 0; i < len(payload); i++ {
+			var short []byte
+			short = append(short, frame[0])
+			short = appendUvarint(short, uint64(i))
+			short = append(short, payload[:i]...)
+
+			if _, err := (binaryCodec{}).ReadMsg(newBufConn(short)); err == nil {
+				t.Errorf("%T with %d of %d payload bytes: no error", msg, i, len(payload))
+			}
+		}
+
+		// and the other way round
+		long := append([]byte{frame[0]}, appendUvarint(nil, uint64(len(payload)+1))...)
+		long = append(append(long, payload...), 0)
+		if _, err := (binaryCodec{}).ReadMsg(newBufConn(long)); err == nil ||
+			!strings.Contains(err.Error(), "trailing") {
+			t.Errorf("%T with a trailing byte: %v", msg, err)
+		}
+	}
+}
+
+func TestBinaryUnknownType(t *testing.T) {
+	frame := []byte{byte(len(binaryTypes)), 0}
+
+	if _, err := (binaryCodec{}).ReadMsg(newBufConn(frame)); err == nil {
+		t.Error("unknown type: no error")
+	}
+
+	type unknown struct{}
+	if err := (binaryCodec{}).WriteMsg(new(bufConn), &unknown{}); err == nil {
+		t.Error("write of an unknown type: no error")
+	}
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+// allocated returns the bytes allocated by f.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestBinaryOversizedFrame(t *testing.T) {
+	for _, size := range []uint64{MaxMsgSize + 1, 1 << 32, 1<<64 - 1} {
+		frame := appendUvarint([]byte{0}, size)
+
+		var err error
+		n := allocated(func() {
+			_, err = (binaryCodec{}).ReadMsg(newBufConn(frame))
+		})
+
+		if err == nil {
+			t.Errorf("size %d: no error", size)
+		}
+		if n >= MaxMsgSize {
+			t.Errorf("size %d: allocated %d bytes", size, n)
+		}
+	}
+
+	// nor is an oversized message written
+	msg := &TunnelResponse{ErrorMsg: strings.Repeat("x", MaxMsgSize)}
+	if err := (binaryCodec{}).WriteMsg(new(bufConn), msg); err == nil {
+		t.Error("write of an oversized message: no error")
+	}
+}
+
+func TestBinaryOversizedLength(t *testing.T) {
+	// length prefixes beyond the payload are rejected before allocating
+	for _, length := range []uint64{100, 1 << 32, 1<<64 - 1} {
+		// AuthRequest.User
+		payload := appendUvarint(nil, length)
+		frame := append(appendUvarint([]byte{0}, uint64(len(payload))), payload...)
+
+		var err error
+		n := allocated(func() {
+			_, err = (binaryCodec{}).ReadMsg(newBufConn(frame))
+		})
+
+		if err == nil {
+			t.Errorf("string length %d: no error", length)
+		}
+		if n >= 1<<16 {
+			t.Errorf("string length %d: allocated %d bytes", length, n)
+		}
+
+		// TunnelRequest.RemoveHeaders after 8 strings, 2 bools and an int
+		payload = bytes.Repeat([]byte{0}, 11)
+		payload = appendUvarint(payload, length)
+		frame = append(appendUvarint([]byte{2}, uint64(len(payload))), payload...)
+
+		n = allocated(func() {
+			_, err = (binaryCodec{}).ReadMsg(newBufConn(frame))
+		})
+
+		if err == nil {
+			t.Errorf("slice length %d: no error", length)
+		}
+		if n >= 1<<16 {
+			t.Errorf("slice length %d: allocated %d bytes", length, n)
+		}
+	}
+}
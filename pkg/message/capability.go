@@ -0,0 +1,25 @@
+package message
+
+// capabilities exchanged in the handshake
+const (
+	// proxy streams are multiplexed over the control connection
+	CapMux = "mux"
+
+	capCodecPrefix = "codec/"
+)
+
+// CodecCapability returns the capability announcing the codec.
+func CodecCapability(name string) string {
+	return capCodecPrefix + name
+}
+
+// HasCapability reports whether caps contains c.
+func HasCapability(caps []string, c string) bool {
+	for _, name := range caps {
+		if name == c {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package message
+
+import (
+	"strings"
+
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary/1"
+)
+
+// Codec frames the messages exchanged after the handshake.
+type Codec interface {
+	Name() string
+	ReadMsg(c conn.IConn) (Message, error)
+	WriteMsg(c conn.IConn, msg Message) error
+}
+
+var codecs = map[string]Codec{
+	CodecJSON:   jsonCodec{},
+	CodecBinary: binaryCodec{},
+}
+
+// SupportedCodecs lists the codecs offered in the handshake, preferred first.
+var SupportedCodecs = []string{CodecBinary, CodecJSON}
+
+// CodecFromCapabilities picks the first codec of the capabilities which we
+// support, json if there is none since that's what peers predating codecs
+// use.
+func CodecFromCapabilities(caps []string) Codec {
+	for _, c := range caps {
+		if !strings.HasPrefix(c, capCodecPrefix) {
+			continue
+		}
+		if codec, ok := codecs[strings.TrimPrefix(c, capCodecPrefix)]; ok {
+			return codec
+		}
+	}
+
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) ReadMsg(c conn.IConn) (Message, error) {
+	return ReadMsg(c)
+}
+
+func (jsonCodec) WriteMsg(c conn.IConn, msg Message) error {
+	return WriteMsg(c, msg)
+}
@@ -3,25 +3,32 @@ package message
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/tianhongw/grp/pkg/conn"
 )
 
+// MaxMsgSize caps the size of a single message, a peer announcing a bigger
+// one is treated as broken instead of making us allocate the buffer.
+const MaxMsgSize = 1 << 20
+
+// ReadMsg reads a message in the legacy json framing, which is also used for
+// the handshake before a codec is negotiated.
 func ReadMsg(c conn.IConn) (Message, error) {
 	var size int64
 	if err := binary.Read(c, binary.LittleEndian, &size); err != nil {
 		return nil, err
 	}
 
+	if size < 0 || size > MaxMsgSize {
+		return nil, fmt.Errorf("message size: %d out of range", size)
+	}
+
 	buf := make([]byte, size)
 
-	n, err := c.Read(buf)
+	n, err := io.ReadFull(c, buf)
 	if err != nil {
-		return nil, err
-	}
-
-	if int64(n) != size {
-		return nil, fmt.Errorf("expected: %d bytes, but got: %d bytes", size, n)
+		return nil, fmt.Errorf("expected: %d bytes, but got: %d bytes: %v", size, n, err)
 	}
 
 	return Unpack(buf)
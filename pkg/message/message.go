@@ -16,6 +16,8 @@ func init() {
 	TypeMap["ProxyStart"] = toReflectType((*ProxyStart)(nil))
 	TypeMap["Ping"] = toReflectType((*Ping)(nil))
 	TypeMap["Pong"] = toReflectType((*Pong)(nil))
+	TypeMap["Drain"] = toReflectType((*Drain)(nil))
+	TypeMap["TunnelClose"] = toReflectType((*TunnelClose)(nil))
 }
 
 func toReflectType(v interface{}) reflect.Type {
@@ -28,13 +30,39 @@ type Message interface{}
 type AuthRequest struct {
 	User     string
 	Password string
+	Token    string
 	ClientId string
+
+	// protocol version of the client, 0 for clients predating versioning
+	Version int
+
+	// software version of the client
+	ClientVersion string
+
+	// features the client asks for, codecs in order of preference
+	Capabilities []string
+
+	// token of the previous control, resumes its tunnels
+	ResumeToken string
 }
 
 // server to client
 type AuthResponse struct {
 	ClientId string
 	ErrorMsg string
+
+	// protocol version used for the session
+	Version int
+
+	// software version of the server
+	ServerVersion string
+
+	// features enabled for the session, at most one codec
+	Capabilities []string
+
+	// presented on reconnect to resume the tunnels, empty if the server
+	// doesn't hold the tunnels of disconnected clients
+	ResumeToken string
 }
 
 // client to server
@@ -47,8 +75,33 @@ type TunnelRequest struct {
 	SubDomain string
 	HttpAuth  string
 
-	// tcp only
+	// tcp and udp only
 	RemotePort int
+
+	// http only, routes the requests below the path on the host, the prefix
+	// is removed from the forwarded requests if StripPrefix is set
+	PathPrefix  string
+	StripPrefix bool
+
+	// tunnels of the same user asking for the same url and group share the
+	// url, public connections are balanced between them with the strategy
+	// of the first member
+	Group   string
+	Balance string
+
+	// http only, rewrite the headers of every request: X-Forwarded-For is
+	// always set, X-Forwarded-Proto and -Host if XForwarded is, then the
+	// headers are removed, set and added, and the Host replaced by
+	// HostHeader, the only rule that may change it
+	XForwarded    bool
+	RemoveHeaders []string
+	SetHeaders    map[string]string
+	AddHeaders    map[string]string
+	HostHeader    string
+
+	// http only, forward the requests as h2c, the local service speaks
+	// http/2 without tls
+	H2C bool
 }
 
 // server to client
@@ -59,6 +112,12 @@ type TunnelResponse struct {
 	ErrorMsg  string
 }
 
+// client to server, releases a tunnel without closing the control, server to
+// client, the tunnel was closed by the server
+type TunnelClose struct {
+	URL string
+}
+
 // server to client
 type ProxyRequest struct {
 }
@@ -81,3 +140,10 @@ type Ping struct {
 // client to server or server to client
 type Pong struct {
 }
+
+// server to client, the server is shutting down: it accepts no more public
+// connections and closes the control once the connections being proxied are
+// done, or after DeadlineSec at the latest. The client should reconnect.
+type Drain struct {
+	DeadlineSec int
+}
@@ -0,0 +1,267 @@
+// Package metrics implements counters and gauges exposed in the
+// prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+type Collector interface {
+	// Write writes the metric in text exposition format.
+	Write(w io.Writer) error
+}
+
+type sample struct {
+	labelValues []string
+	value       uint64 // float64 bits
+}
+
+func (s *sample) add(delta float64) {
+	s.value = math.Float64bits(math.Float64frombits(s.value) + delta)
+}
+
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+}
+
+func (v *vec) update(labelValues []string, f func(s *sample)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d",
+			v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		v.samples[key] = s
+	}
+
+	f(s)
+}
+
+func (v *vec) delete(labelValues []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.samples, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) Write(w io.Writer) error {
+	v.mu.Lock()
+	samples := make([]sample, 0, len(v.samples))
+	for _, s := range v.samples {
+		samples = append(samples, *s)
+	}
+	v.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") <
+			strings.Join(samples[j].labelValues, "\xff")
+	})
+
+	if err := writeHeader(w, v.name, v.help, v.typ); err != nil {
+		return err
+	}
+
+	// a metric without labels is reported even before it's updated
+	if len(v.labels) == 0 && len(samples) == 0 {
+		samples = append(samples, sample{})
+	}
+
+	for _, s := range samples {
+		if err := writeSample(w, v.name, v.labels, s.labelValues,
+			math.Float64frombits(s.value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec creates a counter partitioned by the labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newVec(name, help, typeCounter, labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter, negative deltas are ignored.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	c.update(labelValues, func(s *sample) { s.add(delta) })
+}
+
+// Delete removes the counter of the label values.
+func (c *CounterVec) Delete(labelValues ...string) {
+	c.delete(labelValues)
+}
+
+// GaugeFunc is a gauge whose value is computed on every scrape.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, fn: fn}
+}
+
+func (g *GaugeFunc) Write(w io.Writer) error {
+	if err := writeHeader(w, g.name, g.help, typeGauge); err != nil {
+		return err
+	}
+
+	return writeSample(w, g.name, nil, nil, g.fn())
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, cs...)
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		if err := c.Write(bw); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+var defaultRegistry = NewRegistry()
+
+// Register adds the collectors to the default registry.
+func Register(cs ...Collector) {
+	defaultRegistry.Register(cs...)
+}
+
+// Handler serves the metrics of the default registry.
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+func writeHeader(w io.Writer, name, help, typ string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+	return err
+}
+
+func writeSample(w io.Writer, name string, labels, labelValues []string, value float64) error {
+	var sb strings.Builder
+	sb.WriteString(name)
+
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(l)
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabelValue(labelValues[i]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(formatValue(value))
+	sb.WriteByte('\n')
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeString(t *testing.T, c Collector) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("grp_requests_total", "Requests served.", "url", "proto")
+
+	c.Inc("http://b.nrp.me", "http")
+	c.Inc("http://a.nrp.me", "http")
+	c.Add(2.5, "http://a.nrp.me", "http")
+	// negative deltas are ignored
+	c.Add(-10, "http://a.nrp.me", "http")
+
+	want := `# HELP grp_requests_total Requests served.
+# TYPE grp_requests_total counter
+grp_requests_total{url="http://a.nrp.me",proto="http"} 3.5
+grp_requests_total{url="http://b.nrp.me",proto="http"} 1
+`
+	if got := writeString(t, c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterVecNoLabels(t *testing.T) {
+	c := NewCounterVec("grp_errors_total", "Errors.")
+
+	want := `# HELP grp_errors_total Errors.
+# TYPE grp_errors_total counter
+grp_errors_total 0
+`
+	if got := writeString(t, c); got != want {
+		t.Errorf("before update got:\n%s\nwant:\n%s", got, want)
+	}
+
+	c.Inc()
+	c.Inc()
+
+	want = strings.Replace(want, "grp_errors_total 0", "grp_errors_total 2", 1)
+	if got := writeString(t, c); got != want {
+		t.Errorf("after update got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterVecDelete(t *testing.T) {
+	c := NewCounterVec("grp_conns_total", "Connections.", "url")
+
+	c.Inc("a")
+	c.Inc("b")
+	c.Delete("a")
+	// unknown label values are a no-op
+	c.Delete("c")
+
+	want := `# HELP grp_conns_total Connections.
+# TYPE grp_conns_total counter
+grp_conns_total{url="b"} 1
+`
+	if got := writeString(t, c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// a deleted counter starts over
+	c.Inc("a")
+	if got := writeString(t, c); !strings.Contains(got, `grp_conns_total{url="a"} 1`+"\n") {
+		t.Errorf("recreated counter not reset:\n%s", got)
+	}
+}
+
+func TestCounterVecLabelCount(t *testing.T) {
+	c := NewCounterVec("grp_x_total", "X.", "a", "b")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on a wrong number of label values")
+		}
+	}()
+
+	c.Inc("only-one")
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounterVec("grp_esc_total", "Back\\slash and\nnew line.", "v")
+
+	c.Inc("a\\b\"c\nd")
+
+	want := `# HELP grp_esc_total Back\\slash and\nnew line.
+# TYPE grp_esc_total counter
+grp_esc_total{v="a\\b\"c\nd"} 1
+`
+	if got := writeString(t, c); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	v := 3.0
+	g := NewGaugeFunc("grp_tunnels", "Open tunnels.", func() float64 { return v })
+
+	want := `# HELP grp_tunnels Open tunnels.
+# TYPE grp_tunnels gauge
+grp_tunnels 3
+`
+	if got := writeString(t, g); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// the value is computed on every scrape
+	v = 0.25
+	if got := writeString(t, g); !strings.HasSuffix(got, "grp_tunnels 0.25\n") {
+		t.Errorf("gauge not recomputed:\n%s", got)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{42, "42"},
+		{1.5, "1.5"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		if got := formatValue(tt.v); got != tt.want {
+			t.Errorf("formatValue(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+
+	c := NewCounterVec("grp_a_total", "A.", "k")
+	c.Inc("x")
+	g := NewGaugeFunc("grp_b", "B.", func() float64 { return 7 })
+	r.Register(c, g)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type: %q", ct)
+	}
+
+	want := `# HELP grp_a_total A.
+# TYPE grp_a_total counter
+grp_a_total{k="x"} 1
+# HELP grp_b B.
+# TYPE grp_b gauge
+grp_b 7
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
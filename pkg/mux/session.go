@@ -0,0 +1,318 @@
+// Package mux multiplexes many logical streams over a single connection.
+//
+// Every frame starts with a fixed header:
+//
+//	version(1) type(1) flags(2) stream id(4) length(4)
+//
+// data frames carry length bytes of payload, window update frames carry no
+// payload and use length as the window increment. Each stream has its own
+// receive window so a slow stream never blocks the others.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+const (
+	protoVersion uint8 = 0
+
+	typeData         uint8 = 0
+	typeWindowUpdate uint8 = 1
+
+	flagSYN uint16 = 1 << 0
+	flagFIN uint16 = 1 << 1
+	flagRST uint16 = 1 << 2
+
+	headerSize = 12
+
+	// initial receive window of every stream
+	initialWindow = 256 * 1024
+
+	// max payload of a single data frame
+	maxPayloadSize = 16 * 1024
+
+	acceptBacklog = 64
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+
+	ErrWindowExceeded = errors.New("mux: peer exceeded the receive window")
+)
+
+type header [headerSize]byte
+
+func (h *header) encode(typ uint8, flags uint16, id, length uint32) {
+	h[0] = protoVersion
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h *header) version() uint8   { return h[0] }
+func (h *header) typ() uint8       { return h[1] }
+func (h *header) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h *header) streamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h *header) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+// Session is one side of a multiplexed connection, streams opened by the
+// client side have odd ids and streams opened by the server side even ids.
+type Session struct {
+	conn net.Conn
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	acceptCh chan *Stream
+
+	// serializes frames written to conn
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// Client starts the session of the side which dialed conn.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server starts the session of the side which accepted conn.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		nextID:   firstID,
+		acceptCh: make(chan *Stream, acceptBacklog),
+		closed:   make(chan struct{}),
+	}
+
+	go s.recvLoop()
+
+	return s
+}
+
+// Open opens a new stream, the peer gets it from Accept.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// Close closes the underlying connection and every stream of the session.
+func (s *Session) Close() error {
+	return s.closeWithErr(ErrSessionClosed)
+}
+
+// CloseChan is closed once the session is closed.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.closed
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+func (s *Session) closeWithErr(err error) error {
+	var closeErr error
+
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		close(s.closed)
+		closeErr = s.conn.Close()
+	})
+
+	return closeErr
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(typ uint8, flags uint16, id, length uint32, payload []byte) error {
+	var hdr header
+	hdr.encode(typ, flags, id, length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.isClosed() {
+		return s.closeErr()
+	}
+
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		s.closeWithErr(err)
+		return err
+	}
+
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.closeWithErr(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var hdr header
+
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+
+		if hdr.version() != protoVersion {
+			s.closeWithErr(fmt.Errorf("mux: unsupported protocol version: %d", hdr.version()))
+			return
+		}
+
+		var err error
+		switch hdr.typ() {
+		case typeData:
+			err = s.handleData(&hdr)
+		case typeWindowUpdate:
+			err = s.handleWindowUpdate(&hdr)
+		default:
+			err = fmt.Errorf("mux: unknown frame type: %d", hdr.typ())
+		}
+
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+	}
+}
+
+// getStream returns the stream of the frame, creating it when the peer opens
+// a new one, nil means the frame belongs to a stream which no longer exists.
+func (s *Session) getStream(hdr *header) *Stream {
+	id := hdr.streamID()
+
+	s.mu.Lock()
+	stream, ok := s.streams[id]
+	if ok || hdr.flags()&flagSYN == 0 {
+		s.mu.Unlock()
+		return stream
+	}
+
+	stream = newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		// nobody accepts streams fast enough, refuse it
+		s.removeStream(id)
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return nil
+	}
+
+	return stream
+}
+
+func (s *Session) handleData(hdr *header) error {
+	length := hdr.length()
+	if length > initialWindow {
+		return fmt.Errorf("mux: data frame of %d bytes exceeds the window", length)
+	}
+
+	stream := s.getStream(hdr)
+	if stream == nil {
+		_, err := io.CopyN(ioutil.Discard, s.conn, int64(length))
+		return err
+	}
+
+	if length > 0 {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, buf); err != nil {
+			return err
+		}
+
+		if err := stream.receive(buf); err != nil {
+			return err
+		}
+	}
+
+	stream.handleFlags(hdr.flags())
+
+	return nil
+}
+
+func (s *Session) handleWindowUpdate(hdr *header) error {
+	stream := s.getStream(hdr)
+	if stream == nil {
+		return nil
+	}
+
+	stream.incrSendWindow(hdr.length())
+	stream.handleFlags(hdr.flags())
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	client, server := Client(c1), Server(c2)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	t.Helper()
+
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	if cs.ID() != ss.ID() {
+		t.Fatalf("stream ids differ: %d != %d", cs.ID(), ss.ID())
+	}
+
+	return cs, ss
+}
+
+// waitStreams waits for s to have n open streams.
+func waitStreams(t *testing.T, s *Session, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.NumStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d streams, want %d", s.NumStreams(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readFull(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	return buf
+}
+
+func TestStreamIDs(t *testing.T) {
+	client, server := newPair(t)
+
+	for _, want := range []uint32{1, 3, 5} {
+		cs, _ := openPair(t, client, server)
+		if cs.ID() != want {
+			t.Errorf("client stream id: %d, want %d", cs.ID(), want)
+		}
+	}
+
+	ss, err := server.Open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if ss.ID() != 2 {
+		t.Errorf("server stream id: %d, want 2", ss.ID())
+	}
+}
+
+func TestStreamOpenClose(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, ss := openPair(t, client, server)
+
+	if _, err := cs.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readFull(t, ss, 4); string(got) != "ping" {
+		t.Errorf("server read %q", got)
+	}
+
+	if _, err := ss.Write([]byte("pong")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readFull(t, cs, 4); string(got) != "pong" {
+		t.Errorf("client read %q", got)
+	}
+
+	if err := cs.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// closing twice is a no-op
+	if err := cs.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+
+	if _, err := cs.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("write after close: %v, want %v", err, ErrStreamClosed)
+	}
+	if _, err := cs.Read(make([]byte, 1)); err != ErrStreamClosed {
+		t.Errorf("read after close: %v, want %v", err, ErrStreamClosed)
+	}
+
+	if err := ss.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// a stream is dropped once both sides closed it
+	waitStreams(t, client, 0)
+	waitStreams(t, server, 0)
+}
+
+func TestStreamFIN(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, ss := openPair(t, client, server)
+
+	if _, err := cs.Write([]byte("last words")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := cs.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// the data sent before the FIN is read before the EOF
+	got, err := io.ReadAll(ss)
+	if err != nil {
+		t.Fatalf("read all: %v", err)
+	}
+	if string(got) != "last words" {
+		t.Errorf("read %q", got)
+	}
+
+	// the other direction stays open until the server closes it too
+	if server.NumStreams() != 1 {
+		t.Errorf("half closed stream dropped")
+	}
+	if _, err := ss.Write([]byte("reply")); err != nil {
+		t.Errorf("write to half closed stream: %v", err)
+	}
+
+	ss.Close()
+	waitStreams(t, server, 0)
+	waitStreams(t, client, 0)
+}
+
+func TestStreamRST(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, ss := openPair(t, client, server)
+
+	if _, err := cs.Write([]byte("unread")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := client.writeFrame(typeWindowUpdate, flagRST, cs.ID(), 0, nil); err != nil {
+		t.Fatalf("write rst: %v", err)
+	}
+
+	waitStreams(t, server, 0)
+
+	// buffered data is still handed out, then the reset is reported
+	if got := readFull(t, ss, 6); string(got) != "unread" {
+		t.Errorf("read %q", got)
+	}
+	if _, err := ss.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("read after reset: %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := ss.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("write after reset: %v, want %v", err, ErrStreamReset)
+	}
+
+	// no FIN is sent for a reset stream
+	if err := ss.Close(); err != nil {
+		t.Errorf("close reset stream: %v", err)
+	}
+}
+
+func TestStreamRefused(t *testing.T) {
+	client, server := newPair(t)
+
+	// nobody accepts, the stream past the backlog is reset
+	var last *Stream
+	for i := 0; i <= acceptBacklog; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		last = st
+	}
+
+	last.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := last.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("read refused stream: %v, want %v", err, ErrStreamReset)
+	}
+
+	waitStreams(t, server, acceptBacklog)
+}
+
+func TestFlowControl(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, ss := openPair(t, client, server)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), initialWindow/16+1024)
+
+	// the write blocks once the window of the reader is used up
+	cs.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := cs.Write(data)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("write beyond the window: %v, want a timeout", err)
+	}
+	if n != initialWindow {
+		t.Fatalf("wrote %d bytes before blocking, want %d", n, initialWindow)
+	}
+
+	cs.SetWriteDeadline(time.Time{})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(data[n:])
+		done <- err
+	}()
+
+	// reading gives the window back, which unblocks the writer
+	got := readFull(t, ss, len(data))
+	if !bytes.Equal(got, data) {
+		t.Fatal("read data differs from the written one")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer still blocked after the window update")
+	}
+}
+
+func TestWindowExceeded(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, _ := openPair(t, client, server)
+
+	// a peer ignoring the window breaks the session
+	payload := make([]byte, maxPayloadSize)
+	for i := 0; i <= initialWindow/maxPayloadSize; i++ {
+		if err := client.writeFrame(typeData, 0, cs.ID(), maxPayloadSize, payload); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-server.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed")
+	}
+
+	if err := server.closeErr(); err != ErrWindowExceeded {
+		t.Errorf("close error: %v, want %v", err, ErrWindowExceeded)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, _ := openPair(t, client, server)
+
+	cs.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := cs.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("read: %v, want a timeout", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newPair(t)
+
+	cs, ss := openPair(t, client, server)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := ss.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// blocked reads of the peer return once the connection is gone
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("read on a closed session succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read still blocked after the session closed")
+	}
+
+	select {
+	case <-server.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer session not closed")
+	}
+
+	if _, err := cs.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Errorf("read: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := cs.Write([]byte("x")); err != ErrSessionClosed {
+		t.Errorf("write: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := client.Open(); err != ErrSessionClosed {
+		t.Errorf("open: %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := client.Accept(); err != ErrSessionClosed {
+		t.Errorf("accept: %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := Server(c2)
+	defer server.Close()
+	defer c1.Close()
+
+	var hdr header
+	hdr.encode(typeWindowUpdate, flagSYN, 1, 0)
+	hdr[0] = protoVersion + 1
+
+	go c1.Write(hdr[:])
+
+	select {
+	case <-server.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed on a bad version")
+	}
+
+	if _, err := server.Accept(); err == nil {
+		t.Error("accept on a closed session succeeded")
+	}
+}
@@ -0,0 +1,304 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// Stream is a logical connection inside a session, it implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu sync.Mutex
+
+	recvBuf bytes.Buffer
+	// bytes the peer may still send
+	recvWindow uint32
+	// bytes read since the last window update
+	consumed uint32
+
+	// bytes we may still send
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	reset        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream id, unique within the session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+
+			// give the window back once half of it is consumed
+			var delta uint32
+			st.consumed += uint32(n)
+			if st.consumed >= initialWindow/2 && !st.remoteClosed {
+				delta = st.consumed
+				st.consumed = 0
+				st.recvWindow += delta
+			}
+			st.mu.Unlock()
+
+			if delta > 0 {
+				st.session.writeFrame(typeWindowUpdate, 0, st.id, delta, nil)
+			}
+
+			return n, nil
+		}
+
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	total := 0
+
+	for total < len(b) {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return total, ErrStreamReset
+		case st.localClosed:
+			st.mu.Unlock()
+			return total, ErrStreamClosed
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		n := uint32(len(b) - total)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxPayloadSize {
+			n = maxPayloadSize
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(typeData, 0, st.id, n, b[total:total+int(n)]); err != nil {
+			return total, err
+		}
+
+		total += int(n)
+	}
+
+	return total, nil
+}
+
+// Close closes both directions of the stream and tells the peer that no
+// more data is coming.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed || st.reset
+	sendFIN := !st.reset
+	st.mu.Unlock()
+
+	st.notify()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+
+	if sendFIN {
+		return st.session.writeFrame(typeData, flagFIN, st.id, 0, nil)
+	}
+
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.notify()
+
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	st.notify()
+
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	st.notify()
+
+	return nil
+}
+
+// receive buffers the payload of a data frame.
+func (st *Stream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(payload)) > st.recvWindow {
+		return ErrWindowExceeded
+	}
+	st.recvWindow -= uint32(len(payload))
+
+	// nobody reads a closed stream anymore
+	if !st.localClosed {
+		st.recvBuf.Write(payload)
+	}
+
+	asyncNotify(st.recvNotify)
+
+	return nil
+}
+
+func (st *Stream) incrSendWindow(delta uint32) {
+	if delta == 0 {
+		return
+	}
+
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+
+	asyncNotify(st.sendNotify)
+}
+
+func (st *Stream) handleFlags(flags uint16) {
+	if flags&(flagFIN|flagRST) == 0 {
+		return
+	}
+
+	st.mu.Lock()
+	if flags&flagFIN != 0 {
+		st.remoteClosed = true
+	}
+	if flags&flagRST != 0 {
+		st.reset = true
+	}
+	done := st.localClosed || st.reset
+	st.mu.Unlock()
+
+	st.notify()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) notify() {
+	asyncNotify(st.recvNotify)
+	asyncNotify(st.sendNotify)
+}
+
+// wait blocks until notified, the deadline passes or the session closes.
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return errTimeout
+	case <-st.session.closed:
+		return st.session.closeErr()
+	}
+}
+
+func asyncNotify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
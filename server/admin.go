@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/log"
+)
+
+type adminServer struct {
+	token string
+
+	srv *http.Server
+
+	lg log.Logger
+}
+
+type controlInfo struct {
+	ClientId    string    `json:"client_id"`
+	User        string    `json:"user"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastPing    time.Time `json:"last_ping"`
+	Tunnels     []string  `json:"tunnels"`
+}
+
+type tunnelInfo struct {
+	URL         string    `json:"url"`
+	Protocol    string    `json:"protocol"`
+	ClientId    string    `json:"client_id"`
+	User        string    `json:"user"`
+	StartedAt   time.Time `json:"started_at"`
+	Group       string    `json:"group,omitempty"`
+	ActiveConns int64     `json:"active_conns"`
+}
+
+func startAdminServer(cfg *conf.Config) (*adminServer, error) {
+	if cfg.Server.AdminToken == "" {
+		return nil, errors.New("admin_token is required for the admin api")
+	}
+
+	l, err := net.Listen("tcp", cfg.Server.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	lg, err := log.NewLogger(cfg.Log.Type,
+		log.WithLevel(cfg.Log.Level),
+		log.WithPrefix("admin"))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &adminServer{
+		token: cfg.Server.AdminToken,
+		lg:    lg,
+	}
+
+	a.srv = &http.Server{Handler: a.handler()}
+
+	go func() {
+		if err := a.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			a.lg.Errorf("admin server exited: %v", err)
+		}
+	}()
+
+	a.lg.Infof("admin api listening on: %s", l.Addr())
+
+	return a, nil
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/controls", a.authorized(a.handleControls))
+	mux.HandleFunc("/api/controls/", a.authorized(a.handleControl))
+	mux.HandleFunc("/api/tunnels", a.authorized(a.handleTunnels))
+	mux.HandleFunc("/api/reservations", a.authorized(a.handleReservations))
+
+	return mux
+}
+
+func (a *adminServer) exit() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.srv.Shutdown(ctx); err != nil {
+		a.lg.Errorf("shutdown admin server failed: %v", err)
+	}
+}
+
+func (a *adminServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// handleControls lists connected clients.
+func (a *adminServer) handleControls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	infos := make([]*controlInfo, 0)
+	for _, ctl := range gControlRegistry.All() {
+		info := &controlInfo{
+			ClientId:    ctl.clientId,
+			User:        ctl.user,
+			RemoteAddr:  ctl.conn.RemoteAddr().String(),
+			ConnectedAt: ctl.start,
+			LastPing:    ctl.getLastPing(),
+			Tunnels:     make([]string, 0),
+		}
+		for _, t := range ctl.getTunnels() {
+			info.Tunnels = append(info.Tunnels, t.url)
+		}
+		infos = append(infos, info)
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleControl kills a client by DELETE /api/controls/{client_id}.
+func (a *adminServer) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clientId := strings.TrimPrefix(r.URL.Path, "/api/controls/")
+	ctl := gControlRegistry.Get(clientId)
+	if ctl == nil {
+		writeJSONError(w, http.StatusNotFound, "no control find for client: "+clientId)
+		return
+	}
+
+	a.lg.Infof("kill control of client: %s", clientId)
+	ctl.kill()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTunnels lists tunnels, or kills the tunnels of a url by
+// DELETE /api/tunnels?url={url}, only the one of a group member if
+// client_id={id} is given.
+func (a *adminServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		infos := make([]*tunnelInfo, 0)
+		for _, t := range gTunnelRegistry.All() {
+			ctl := t.getCtl()
+			infos = append(infos, &tunnelInfo{
+				URL:         t.url,
+				Protocol:    t.req.Protocol,
+				ClientId:    ctl.clientId,
+				User:        ctl.user,
+				StartedAt:   t.start,
+				Group:       t.req.Group,
+				ActiveConns: t.activeConns(),
+			})
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case http.MethodDelete:
+		url := r.URL.Query().Get("url")
+		clientId := r.URL.Query().Get("client_id")
+
+		var killed int
+		for _, t := range gTunnelRegistry.Members(url) {
+			ctl := t.getCtl()
+			if clientId != "" && ctl.clientId != clientId {
+				continue
+			}
+
+			a.lg.Infof("kill tunnel: %s of client: %s", url, ctl.clientId)
+			ctl.killTunnel(t)
+			killed++
+		}
+
+		if killed == 0 {
+			writeJSONError(w, http.StatusNotFound, "no tunnel find for url: "+url)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleReservations lists reservations, creates one by POST of a json
+// reservation, or revokes one by DELETE /api/reservations?kind={kind}&name={name}.
+func (a *adminServer) handleReservations(w http.ResponseWriter, r *http.Request) {
+	if gReservations == nil {
+		writeJSONError(w, http.StatusNotFound, "reservations are disabled, reservations_file is not set")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, gReservations.list())
+	case http.MethodPost:
+		res := new(reservation)
+		if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid reservation: "+err.Error())
+			return
+		}
+		if err := normalizeReservation(res); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res.CreatedAt = time.Now()
+
+		if err := gReservations.reserve(res); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		a.lg.Infof("reserve %s: %s for user: %s", res.Kind, res.Name, res.User)
+		writeJSON(w, http.StatusCreated, res)
+	case http.MethodDelete:
+		kind := r.URL.Query().Get("kind")
+		name := r.URL.Query().Get("name")
+
+		ok, err := gReservations.revoke(kind, name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no reservation find for "+kind+": "+name)
+			return
+		}
+
+		a.lg.Infof("revoke reservation of %s: %s", kind, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/log"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+const testAdminToken = "adm"
+
+func newTestAdmin(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer((&adminServer{token: testAdminToken, lg: log.DummyLogger}).handler())
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func adminDo(t *testing.T, srv *httptest.Server, method, path, token, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, b
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	setTestGlobals(t, &settings{})
+	srv := newTestAdmin(t)
+
+	for _, path := range []string{"/api/controls", "/api/controls/c1", "/api/tunnels", "/api/reservations"} {
+		for _, token := range []string{"", "wrong", testAdminToken + "x"} {
+			resp, body := adminDo(t, srv, http.MethodGet, path, token, "")
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET %s with token %q: %d", path, token, resp.StatusCode)
+			}
+			if !strings.Contains(string(body), "invalid admin token") {
+				t.Errorf("GET %s with token %q: %s", path, token, body)
+			}
+		}
+	}
+
+	// the token must be a bearer token
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/tunnels", nil)
+	req.Header.Set("Authorization", "Basic "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("basic auth: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminList(t *testing.T) {
+	setTestGlobals(t, &settings{})
+	srv := newTestAdmin(t)
+
+	c, _ := newTestControl(t, "c1", "alice")
+	addTestTunnel(t, c, "http://a.nrp.me:80", nil)
+	addTestTunnel(t, c, "tcp://nrp.me:10000", &message.TunnelRequest{Protocol: "tcp"})
+
+	resp, body := adminDo(t, srv, http.MethodGet, "/api/controls", testAdminToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list controls: %d %s", resp.StatusCode, body)
+	}
+	var controls []*controlInfo
+	if err := json.Unmarshal(body, &controls); err != nil {
+		t.Fatal(err)
+	}
+	if len(controls) != 1 || controls[0].ClientId != "c1" || controls[0].User != "alice" ||
+		len(controls[0].Tunnels) != 2 {
+		t.Errorf("controls: %s", body)
+	}
+
+	resp, body = adminDo(t, srv, http.MethodGet, "/api/tunnels", testAdminToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list tunnels: %d %s", resp.StatusCode, body)
+	}
+	var tunnels []*tunnelInfo
+	if err := json.Unmarshal(body, &tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("tunnels: %s", body)
+	}
+	for _, ti := range tunnels {
+		if ti.ClientId != "c1" || ti.User != "alice" || ti.StartedAt.IsZero() {
+			t.Errorf("tunnel: %+v", ti)
+		}
+	}
+
+	for _, path := range []string{"/api/controls", "/api/controls/c1"} {
+		if resp, _ := adminDo(t, srv, http.MethodPost, path, testAdminToken, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("POST %s: %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminKillTunnel(t *testing.T) {
+	setTestGlobals(t, &settings{})
+	srv := newTestAdmin(t)
+
+	url := "http://g.nrp.me:80"
+	req := &message.TunnelRequest{Protocol: "http", Group: "web"}
+
+	c1, _ := newTestControl(t, "c1", "alice")
+	c2, _ := newTestControl(t, "c2", "alice")
+	t1 := addTestTunnel(t, c1, url, req)
+	t2 := addTestTunnel(t, c2, url, req)
+
+	// unknown urls and clients
+	for _, path := range []string{
+		"/api/tunnels?url=http://x.nrp.me:80",
+		"/api/tunnels",
+		"/api/tunnels?url=" + url + "&client_id=c3",
+	} {
+		resp, body := adminDo(t, srv, http.MethodDelete, path, testAdminToken, "")
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "no tunnel") {
+			t.Errorf("DELETE %s: %d %s", path, resp.StatusCode, body)
+		}
+	}
+
+	// one member of the group
+	resp, body := adminDo(t, srv, http.MethodDelete, "/api/tunnels?url="+url+"&client_id=c1", testAdminToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill member: %d %s", resp.StatusCode, body)
+	}
+	if members := gTunnelRegistry.Members(url); len(members) != 1 || members[0] != t2 {
+		t.Errorf("members after kill: %v", members)
+	}
+	if len(c1.getTunnels()) != 0 || len(c2.getTunnels()) != 1 {
+		t.Error("the tunnel is still held by its control")
+	}
+	select {
+	case <-t1.exitChan:
+	default:
+		t.Error("killed tunnel did not exit")
+	}
+
+	// the whole url
+	resp, body = adminDo(t, srv, http.MethodDelete, "/api/tunnels?url="+url, testAdminToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill url: %d %s", resp.StatusCode, body)
+	}
+	if members := gTunnelRegistry.Members(url); len(members) != 0 {
+		t.Errorf("members after kill: %v", members)
+	}
+
+	// the control survives its tunnels
+	if gControlRegistry.Get("c2") != c2 {
+		t.Error("control of a killed tunnel is gone")
+	}
+}
+
+func TestAdminKillControl(t *testing.T) {
+	setTestGlobals(t, &settings{})
+	srv := newTestAdmin(t)
+
+	c, client := newTestControl(t, "c1", "alice")
+	tunnel := addTestTunnel(t, c, "http://a.nrp.me:80", nil)
+
+	resp, body := adminDo(t, srv, http.MethodDelete, "/api/controls/c2", testAdminToken, "")
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "c2") {
+		t.Errorf("kill unknown control: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = adminDo(t, srv, http.MethodDelete, "/api/controls/c1", testAdminToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill control: %d %s", resp.StatusCode, body)
+	}
+
+	if gControlRegistry.Get("c1") != nil {
+		t.Error("killed control is registered")
+	}
+	if gTunnelRegistry.Lookup("http", "a.nrp.me:80", "/") != nil {
+		t.Error("tunnel of a killed control is registered")
+	}
+	select {
+	case <-tunnel.exitChan:
+	default:
+		t.Error("tunnel of a killed control did not exit")
+	}
+
+	// the client end sees the connection closed
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("control connection is open")
+	}
+
+	resp, _ = adminDo(t, srv, http.MethodDelete, "/api/controls/c1", testAdminToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("kill of a killed control: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminKillControlNotResumable(t *testing.T) {
+	// a killed control releases its tunnels even with resumption enabled
+	setTestGlobals(t, &settings{resumeGrace: time.Minute})
+	srv := newTestAdmin(t)
+
+	c, _ := newTestControl(t, "c1", "alice")
+	c.resumeToken = "r3sume"
+	addTestTunnel(t, c, "http://a.nrp.me:80", nil)
+
+	if resp, body := adminDo(t, srv, http.MethodDelete, "/api/controls/c1", testAdminToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill control: %d %s", resp.StatusCode, body)
+	}
+
+	if len(gTunnelRegistry.All()) != 0 {
+		t.Error("tunnels of a killed control are held")
+	}
+	if len(gResumeStore.sessions) != 0 {
+		t.Error("tunnels of a killed control are parked")
+	}
+}
+
+func TestAdminReservations(t *testing.T) {
+	setTestGlobals(t, &settings{})
+	srv := newTestAdmin(t)
+
+	// disabled without a reservations file
+	if resp, _ := adminDo(t, srv, http.MethodGet, "/api/reservations", testAdminToken, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("disabled reservations: %d", resp.StatusCode)
+	}
+
+	file := filepath.Join(t.TempDir(), "reservations.json")
+	rs, err := loadReservationStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gReservations = rs
+
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, "/api/reservations", `{"kind":"sub_domain","name":"Foo","user":"alice"}`, http.StatusCreated},
+		{http.MethodPost, "/api/reservations", `{"kind":"sub_domain","name":"bar"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/reservations", `{"kind":"port","name":"0","user":"alice"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/reservations", `{`, http.StatusBadRequest},
+		{http.MethodDelete, "/api/reservations?kind=sub_domain&name=bar", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/reservations?kind=sub_domain&name=foo", "", http.StatusNoContent},
+		{http.MethodDelete, "/api/reservations?kind=sub_domain&name=foo", "", http.StatusNotFound},
+		{http.MethodPut, "/api/reservations", "", http.StatusMethodNotAllowed},
+	}
+
+	for i, tt := range tests {
+		resp, body := adminDo(t, srv, tt.method, tt.path, testAdminToken, tt.body)
+		if resp.StatusCode != tt.code {
+			t.Errorf("%d: %s %s: %d %s, want %d", i, tt.method, tt.path, resp.StatusCode, body, tt.code)
+		}
+
+		if i == 0 {
+			// listed and saved
+			_, body := adminDo(t, srv, http.MethodGet, "/api/reservations", testAdminToken, "")
+			if !strings.Contains(string(body), `"name":"foo"`) {
+				t.Errorf("reservations: %s", body)
+			}
+			if saved, err := loadReservationStore(file); err != nil || len(saved.list()) != 1 {
+				t.Errorf("saved reservations: %v", err)
+			}
+		}
+	}
+}
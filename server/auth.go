@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/message"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+type Authenticator interface {
+	// Authenticate verifies the credentials of the auth request and
+	// returns the authenticated user.
+	Authenticate(req *message.AuthRequest) (string, error)
+}
+
+const (
+	AuthTypeNone     = "none"
+	AuthTypeToken    = "token"
+	AuthTypeHtpasswd = "htpasswd"
+	AuthTypeHTTP     = "http"
+
+	defaultAuthTimeoutSec = 5
+)
+
+func newAuthenticator(opt *conf.AuthOption) (Authenticator, error) {
+	if opt == nil {
+		return &noneAuthenticator{}, nil
+	}
+
+	switch strings.ToLower(opt.Type) {
+	case AuthTypeNone, "":
+		return &noneAuthenticator{}, nil
+	case AuthTypeToken:
+		return newTokenAuthenticator(opt.Tokens)
+	case AuthTypeHtpasswd:
+		return newHtpasswdAuthenticator(opt.HtpasswdFile)
+	case AuthTypeHTTP:
+		return newHTTPAuthenticator(opt.URL, opt.TimeoutSec)
+	default:
+		return nil, fmt.Errorf("unknown auth type: %s", opt.Type)
+	}
+}
+
+type noneAuthenticator struct{}
+
+func (a *noneAuthenticator) Authenticate(req *message.AuthRequest) (string, error) {
+	return req.User, nil
+}
+
+type tokenAuthenticator struct {
+	tokens []*conf.TokenOption
+}
+
+func newTokenAuthenticator(tokens []*conf.TokenOption) (*tokenAuthenticator, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens configured for token auth")
+	}
+
+	for _, t := range tokens {
+		if t.Token == "" {
+			return nil, errors.New("empty token configured for token auth")
+		}
+		if t.User == "" {
+			return nil, errors.New("token configured without a user for token auth")
+		}
+	}
+
+	return &tokenAuthenticator{tokens: tokens}, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(req *message.AuthRequest) (string, error) {
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(req.Token)) == 1 {
+			return t.User, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: invalid token", errAuthFailed)
+}
+
+type htpasswdAuthenticator struct {
+	passwords map[string]string
+}
+
+func newHtpasswdAuthenticator(file string) (*htpasswdAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &htpasswdAuthenticator{
+		passwords: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed htpasswd line: %s", line)
+		}
+
+		a.passwords[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *htpasswdAuthenticator) Authenticate(req *message.AuthRequest) (string, error) {
+	hash, ok := a.passwords[req.User]
+	if !ok || !checkHtpasswd(hash, req.Password) {
+		return "", fmt.Errorf("%w: invalid user or password", errAuthFailed)
+	}
+
+	return req.User, nil
+}
+
+func checkHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"),
+		strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$"):
+		// md5 and crypt hashes are not supported
+		return false
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
+
+type httpAuthenticator struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPAuthenticator(url string, timeoutSec int) (*httpAuthenticator, error) {
+	if url == "" {
+		return nil, errors.New("no url configured for http auth")
+	}
+
+	if timeoutSec == 0 {
+		timeoutSec = defaultAuthTimeoutSec
+	}
+
+	return &httpAuthenticator{
+		url: url,
+		client: &http.Client{
+			Timeout: time.Duration(timeoutSec) * time.Second,
+		},
+	}, nil
+}
+
+type httpAuthRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	ClientId string `json:"client_id"`
+}
+
+type httpAuthResponse struct {
+	User  string `json:"user"`
+	Error string `json:"error"`
+}
+
+// Authenticate posts the credentials as json to the auth service, any 2xx
+// status with the user in the response body accepts the client as that user.
+func (a *httpAuthenticator) Authenticate(req *message.AuthRequest) (string, error) {
+	body, err := json.Marshal(&httpAuthRequest{
+		User:     req.User,
+		Password: req.Password,
+		Token:    req.Token,
+		ClientId: req.ClientId,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("call auth service failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read auth service response failed: %v", err)
+	}
+
+	var authResp httpAuthResponse
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		// a non json body is ignored, it names no user
+		_ = json.Unmarshal(respBody, &authResp)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if authResp.Error != "" {
+			return "", fmt.Errorf("%w: %s", errAuthFailed, authResp.Error)
+		}
+		return "", errAuthFailed
+	}
+
+	if authResp.User == "" {
+		return "", errors.New("auth service response names no user")
+	}
+
+	return authResp.User, nil
+}
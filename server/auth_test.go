@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/message"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokenAuthenticatorConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []*conf.TokenOption
+		ok     bool
+	}{
+		{"valid", []*conf.TokenOption{{Token: "t", User: "alice"}}, true},
+		{"no tokens", nil, false},
+		{"empty token", []*conf.TokenOption{{User: "alice"}}, false},
+		{"no user", []*conf.TokenOption{{Token: "t"}}, false},
+		{"one without a user", []*conf.TokenOption{{Token: "a", User: "alice"}, {Token: "b"}}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := newTokenAuthenticator(tt.tokens)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok: %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a, err := newTokenAuthenticator([]*conf.TokenOption{
+		{Token: "tok-a", User: "alice"},
+		{Token: "tok-b", User: "bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req  message.AuthRequest
+		want string
+		ok   bool
+	}{
+		{message.AuthRequest{Token: "tok-a"}, "alice", true},
+		{message.AuthRequest{Token: "tok-b"}, "bob", true},
+		// the user of the request is never trusted
+		{message.AuthRequest{Token: "tok-a", User: "bob"}, "alice", true},
+		{message.AuthRequest{Token: "tok-c", User: "alice"}, "", false},
+		{message.AuthRequest{Token: "tok", User: "alice"}, "", false},
+		{message.AuthRequest{User: "alice"}, "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := a.Authenticate(&tt.req)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("Authenticate(%+v) = %q, %v, want %q, ok: %v", tt.req, got, err, tt.want, tt.ok)
+		}
+		if err != nil && !errors.Is(err, errAuthFailed) {
+			t.Errorf("Authenticate(%+v): %v is not an auth failure", tt.req, err)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("sha-pw"))
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# comment\n\nplain:plain-pw\nsha:{SHA}%s\nbcrypt:%s\nmd5:$apr1$salt$hash\n",
+		base64.StdEncoding.EncodeToString(sum[:]), bcryptHash)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newHtpasswdAuthenticator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"plain", "plain-pw", true},
+		{"plain", "plain", false},
+		{"sha", "sha-pw", true},
+		{"sha", "plain-pw", false},
+		{"bcrypt", "bcrypt-pw", true},
+		{"bcrypt", "sha-pw", false},
+		// unsupported hashes never match
+		{"md5", "$apr1$salt$hash", false},
+		{"nobody", "plain-pw", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := a.Authenticate(&message.AuthRequest{User: tt.user, Password: tt.password})
+		if (err == nil) != tt.ok {
+			t.Errorf("Authenticate(%s, %s): %v, want ok: %v", tt.user, tt.password, err, tt.ok)
+		}
+		if tt.ok && got != tt.user {
+			t.Errorf("Authenticate(%s, %s) = %q", tt.user, tt.password, got)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticatorMalformed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(file, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newHtpasswdAuthenticator(file); err == nil {
+		t.Error("malformed line: no error")
+	}
+	if _, err := newHtpasswdAuthenticator(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestHTTPAuthenticator(t *testing.T) {
+	var got httpAuthRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = httpAuthRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode auth request: %v", err)
+		}
+
+		switch got.Token {
+		case "ok":
+			fmt.Fprint(w, `{"user":"alice"}`)
+		case "no-user":
+			fmt.Fprint(w, `{}`)
+		case "empty":
+		case "text":
+			fmt.Fprint(w, "alice")
+		case "denied":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":"token revoked"}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	a, err := newHTTPAuthenticator(srv.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token   string
+		want    string
+		failure bool
+		errText string
+	}{
+		{"ok", "alice", false, ""},
+		// the user of the request is never trusted
+		{"no-user", "", false, "names no user"},
+		{"empty", "", false, "names no user"},
+		{"text", "", false, "names no user"},
+		{"denied", "", true, "token revoked"},
+		{"unknown", "", true, ""},
+	}
+
+	for _, tt := range tests {
+		req := &message.AuthRequest{User: "bob", Password: "pw", Token: tt.token, ClientId: "c1"}
+
+		user, err := a.Authenticate(req)
+		if user != tt.want {
+			t.Errorf("%s: user %q, want %q", tt.token, user, tt.want)
+		}
+		if tt.want != "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.token, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%s: no error", tt.token)
+			continue
+		}
+		if errors.Is(err, errAuthFailed) != tt.failure {
+			t.Errorf("%s: %v, want an auth failure: %v", tt.token, err, tt.failure)
+		}
+		if !strings.Contains(err.Error(), tt.errText) {
+			t.Errorf("%s: %v, want %q", tt.token, err, tt.errText)
+		}
+	}
+
+	want := httpAuthRequest{User: "bob", Password: "pw", Token: "unknown", ClientId: "c1"}
+	if got != want {
+		t.Errorf("auth request %+v, want %+v", got, want)
+	}
+
+	if _, err := newHTTPAuthenticator("", 0); err == nil {
+		t.Error("no url: no error")
+	}
+}
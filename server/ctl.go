@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -12,12 +13,17 @@ import (
 	"github.com/tianhongw/grp/pkg/conn"
 	"github.com/tianhongw/grp/pkg/log"
 	"github.com/tianhongw/grp/pkg/message"
+	"github.com/tianhongw/grp/pkg/mux"
 	"github.com/tianhongw/grp/pkg/util"
+	"github.com/tianhongw/grp/version"
 )
 
 type Control struct {
 	clientId string
 
+	// authenticated user, or the client certificate subject
+	user string
+
 	auth *message.AuthRequest
 
 	// actual connection
@@ -29,15 +35,36 @@ type Control struct {
 	// read from the channel to get msg from client
 	in chan (message.Message)
 
+	// guards lastPing and tunnels
+	mu sync.Mutex
+
+	start time.Time
+
 	lastPing time.Time
 
 	proxies chan conn.IConn
 
+	// multiplexed transport, nil if the client dials a connection per proxy
+	session *mux.Session
+
+	// frames the messages after the handshake
+	codec message.Codec
+
+	// protocol version of the session
+	version int
+
+	// resumes the tunnels of the control after a disconnect, empty if
+	// resumption is disabled
+	resumeToken string
+
 	tunnels []*Tunnel
 
 	exitChan  chan struct{}
 	waitGroup util.WaitGroupWrapper
 
+	// closed once the control is done exiting
+	exited chan struct{}
+
 	lg log.Logger
 
 	isExiting int32
@@ -47,10 +74,19 @@ type Control struct {
 
 const (
 	defaultProxyMaxSize = 10
+
+	// first protocol version knowing the drain message
+	drainProtocolVersion = 4
+
+	// first protocol version knowing the tunnel close message
+	tunnelCloseProtocolVersion = 5
 )
 
+// newControl creates the control for an authenticated client, identity is
+// the subject of the verified client certificate and takes precedence over
+// the client id asserted in the auth request.
 func newControl(cfg *conf.Config, ctlConn conn.IConn,
-	authReq *message.AuthRequest) *Control {
+	authReq *message.AuthRequest, identity, user string) (*Control, error) {
 
 	c := &Control{
 		auth:     authReq,
@@ -61,10 +97,21 @@ func newControl(cfg *conf.Config, ctlConn conn.IConn,
 		proxies:  make(chan conn.IConn, defaultProxyMaxSize),
 		tunnels:  make([]*Tunnel, 0),
 		exitChan: make(chan struct{}),
+		exited:   make(chan struct{}),
+		start:    time.Now(),
 		lastPing: time.Now(),
 		cfg:      cfg,
 	}
 
+	if identity != "" {
+		c.clientId = identity
+	}
+
+	c.user = user
+	if c.user == "" {
+		c.user = identity
+	}
+
 	if c.clientId == "" {
 		c.clientId = util.NewStringID()
 	}
@@ -78,24 +125,127 @@ func newControl(cfg *conf.Config, ctlConn conn.IConn,
 
 	c.lg = lg
 
+	if err := gControlRegistry.checkIdentity(c.clientId, identity); err != nil {
+		message.WriteMsg(ctlConn, &message.AuthResponse{ErrorMsg: err.Error()})
+		return nil, err
+	}
+	gControlRegistry.bindIdentity(c.clientId, identity)
+
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+
 	if replacedCtl := gControlRegistry.Add(c.clientId, c); replacedCtl != nil {
 		replacedCtl.waitGroup.Wait()
 	}
 
-	go func() {
-		c.out <- &message.AuthResponse{
-			ClientId: c.clientId,
-		}
-
+	if c.session == nil {
 		// ask for a proxy connection
-		c.out <- &message.ProxyRequest{}
-	}()
+		go c.send(&message.ProxyRequest{})
+	}
 
 	c.waitGroup.Wrap(c.manager)
 	c.waitGroup.Wrap(c.reader)
 	c.waitGroup.Wrap(c.writer)
 
-	return c
+	return c, nil
+}
+
+// handshake answers the auth request with the negotiated protocol version
+// and capabilities, the answer is always json framed, the negotiated codec
+// applies to the messages after it.
+func (c *Control) handshake() error {
+	ver, caps := negotiate(c.auth)
+
+	c.version = ver
+	c.codec = message.CodecFromCapabilities(caps)
+
+	if getSettings().resumeGrace > 0 {
+		c.resumeToken = newResumeToken()
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(getSettings().connWriteTimeout))
+	if err := message.WriteMsg(c.conn, &message.AuthResponse{
+		ClientId:      c.clientId,
+		Version:       ver,
+		ServerVersion: version.Version,
+		Capabilities:  caps,
+		ResumeToken:   c.resumeToken,
+	}); err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Time{})
+
+	c.lg.Infof("client version: %s, protocol version: %d, capabilities: %v",
+		c.auth.ClientVersion, ver, caps)
+
+	if message.HasCapability(caps, message.CapMux) {
+		return c.startSession()
+	}
+
+	return nil
+}
+
+// negotiate picks the protocol version of the session, a newer client is
+// downgraded to ours, and the capabilities both sides support.
+func negotiate(req *message.AuthRequest) (int, []string) {
+	ver := req.Version
+	if ver > version.ProtocolVersion {
+		ver = version.ProtocolVersion
+	}
+
+	var caps []string
+
+	if message.HasCapability(req.Capabilities, message.CapMux) {
+		caps = append(caps, message.CapMux)
+	}
+
+	// the binary codec encodes fields by position, it's only safe when both
+	// sides have the same messages
+	codecCaps := req.Capabilities
+	if req.Version != version.ProtocolVersion {
+		codecCaps = nil
+	}
+	codec := message.CodecFromCapabilities(codecCaps)
+	caps = append(caps, message.CodecCapability(codec.Name()))
+
+	return ver, caps
+}
+
+// checkProtocolVersion rejects clients too old for us.
+func checkProtocolVersion(ver, minVer int) error {
+	if minVer < version.MinProtocolVersion {
+		minVer = version.MinProtocolVersion
+	}
+
+	if ver < minVer {
+		return fmt.Errorf("unsupported protocol version: %d, server requires %d to %d, please upgrade nrpc",
+			ver, minVer, version.ProtocolVersion)
+	}
+
+	return nil
+}
+
+// startSession accepts the multiplexing asked by the client, the control
+// messages then flow over the first stream opened by the client and every
+// proxy is a stream opened by the server.
+func (c *Control) startSession() error {
+	session := mux.Server(c.conn)
+
+	c.conn.SetReadDeadline(time.Now().Add(getSettings().connReadTimeout))
+	stream, err := session.Accept()
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("accept control stream failed: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	c.session = session
+	c.conn = conn.WrapConn(stream, "control")
+
+	c.lg.Info("multiplexing proxy streams over the control connection")
+
+	return nil
 }
 
 func (c *Control) registerTunnel(req *message.TunnelRequest) {
@@ -105,28 +255,150 @@ func (c *Control) registerTunnel(req *message.TunnelRequest) {
 
 		c.lg.Debugf("register tunnel: %v", newReq)
 
+		if err := getSettings().policies.get(c.user).check(&newReq, c.userTunnels(), c.cfg.Server.Domain); err != nil {
+			c.lg.Warningf("tunnel denied for user: %s: %v", c.user, err)
+			c.send(&message.TunnelResponse{
+				RequestId: req.RequestId,
+				Protocol:  proto,
+				ErrorMsg:  fmt.Sprintf("tunnel denied: %v", err),
+			})
+			continue
+		}
+
+		if t := gResumeStore.claim(c, &newReq); t != nil {
+			c.lg.Infof("resume tunnel: %s", t.url)
+
+			c.mu.Lock()
+			c.tunnels = append(c.tunnels, t)
+			c.mu.Unlock()
+
+			c.send(&message.TunnelResponse{
+				RequestId: req.RequestId,
+				URL:       t.url,
+				Protocol:  proto,
+			})
+			continue
+		}
+
 		t, err := NewTunnel(&newReq, c, c.cfg)
 		if err != nil {
 			c.lg.Errorf("register tunnel failed: %v", err)
-			c.out <- &message.TunnelResponse{
-				ErrorMsg: err.Error(),
-			}
-			if len(c.tunnels) == 0 {
-				c.exit()
-			}
-			return
+			c.send(&message.TunnelResponse{
+				RequestId: req.RequestId,
+				Protocol:  proto,
+				ErrorMsg:  err.Error(),
+			})
+			continue
 		}
 
+		c.mu.Lock()
 		c.tunnels = append(c.tunnels, t)
-		c.out <- &message.TunnelResponse{
+		c.mu.Unlock()
+
+		c.send(&message.TunnelResponse{
 			RequestId: req.RequestId,
 			URL:       t.url,
 			Protocol:  proto,
+		})
+	}
+}
+
+// userTunnels returns the number of tunnels the user of c has over all its
+// controls, anonymous clients only count their own.
+func (c *Control) userTunnels() int {
+	if c.user == "" {
+		return len(c.getTunnels())
+	}
+
+	var n int
+	for _, ctl := range gControlRegistry.All() {
+		if ctl == c || ctl.user == c.user {
+			n += len(ctl.getTunnels())
 		}
 	}
+
+	return n
+}
+
+func (c *Control) getTunnels() []*Tunnel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tunnels := make([]*Tunnel, len(c.tunnels))
+	copy(tunnels, c.tunnels)
+
+	return tunnels
+}
+
+// closeTunnel shuts down one tunnel of the control and releases its url.
+func (c *Control) closeTunnel(t *Tunnel) {
+	c.mu.Lock()
+	for i, ct := range c.tunnels {
+		if ct == t {
+			c.tunnels = append(c.tunnels[:i], c.tunnels[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	t.exit()
+}
+
+// killTunnel closes t on behalf of the server and tells the client, which
+// forgets it. Clients predating the tunnel close keep it until they
+// reconnect.
+func (c *Control) killTunnel(t *Tunnel) {
+	c.closeTunnel(t)
+
+	if c.version < tunnelCloseProtocolVersion {
+		return
+	}
+
+	c.send(&message.TunnelClose{URL: t.url})
+}
+
+// drain tells the client the server is going away, clients predating the
+// drain message only learn it once the control is closed.
+func (c *Control) drain(timeout time.Duration) {
+	if c.version < drainProtocolVersion {
+		return
+	}
+
+	c.send(&message.Drain{DeadlineSec: int(timeout / time.Second)})
+}
+
+// releaseTunnel closes the tunnels of the control serving url, on request
+// of the client.
+func (c *Control) releaseTunnel(url string) {
+	for _, t := range c.getTunnels() {
+		if t.url == url {
+			c.lg.Infof("release tunnel: %s", url)
+			c.closeTunnel(t)
+		}
+	}
+}
+
+func (c *Control) getLastPing() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastPing
+}
+
+// send queues the message for the writer, it gives up once the control exits.
+func (c *Control) send(msg message.Message) {
+	select {
+	case c.out <- msg:
+	case <-c.exitChan:
+	}
 }
 
 func (c *Control) registerProxy(conn conn.IConn) {
+	if atomic.LoadInt32(&c.isExiting) == 1 {
+		conn.Close()
+		return
+	}
+
 	conn.SetDeadline(time.Now().Add(defaultProxyConnTimeout))
 	select {
 	case c.proxies <- conn:
@@ -138,24 +410,29 @@ func (c *Control) registerProxy(conn conn.IConn) {
 }
 
 func (c *Control) getProxy() (conn.IConn, error) {
-	select {
-	case proxyConn, ok := <-c.proxies:
-		if !ok {
-			return nil, errors.New("control is exiting")
+	if c.session != nil {
+		stream, err := c.session.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open proxy stream failed: %v", err)
 		}
+		return conn.WrapConn(stream, "proxy"), nil
+	}
+
+	select {
+	case proxyConn := <-c.proxies:
 		return proxyConn, nil
+	case <-c.exitChan:
+		return nil, errors.New("control is exiting")
 	default:
-		go func() {
-			c.out <- message.ProxyRequest{}
-		}()
+		go c.send(&message.ProxyRequest{})
 
 		select {
-		case proxyConn, ok := <-c.proxies:
-			if !ok {
-				return nil, errors.New("control is exiting")
-			}
+		case proxyConn := <-c.proxies:
 			return proxyConn, nil
+		case <-c.exitChan:
+			return nil, errors.New("control is exiting")
 		case <-time.After(defaultPingCheckInterval):
+			metricProxyTimeouts.Inc()
 			return nil, errors.New("get proxy connection timeout")
 		}
 	}
@@ -175,13 +452,17 @@ func (c *Control) manager() {
 			switch mt := rawMsg.(type) {
 			case *message.TunnelRequest:
 				c.registerTunnel(mt)
+			case *message.TunnelClose:
+				c.releaseTunnel(mt.URL)
 			case *message.Ping:
+				c.mu.Lock()
 				c.lastPing = time.Now()
-				c.out <- &message.Pong{}
+				c.mu.Unlock()
+				c.send(&message.Pong{})
 			}
 		case <-reap.C:
-			if time.Since(c.lastPing) > defaultPingCheckInterval {
-				c.lg.Errorf("lost heartbeat, last time is : %v", c.lastPing)
+			if lastPing := c.getLastPing(); time.Since(lastPing) > defaultPingCheckInterval {
+				c.lg.Errorf("lost heartbeat, last time is : %v", lastPing)
 				go func() { c.exit() }()
 			}
 		case <-c.exitChan:
@@ -191,42 +472,36 @@ func (c *Control) manager() {
 }
 
 func (c *Control) reader() {
-	timeout := c.cfg.Server.ConnReadTimeoutSec
-	if timeout == 0 {
-		timeout = defaultConnReadTimeoutSec
-	}
-
 	for {
 		select {
 		case <-c.exitChan:
 			return
 		default:
-			c.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-			msg, err := message.ReadMsg(c.conn)
+			c.conn.SetReadDeadline(time.Now().Add(getSettings().connReadTimeout))
+			msg, err := c.codec.ReadMsg(c.conn)
 			if err != nil {
-				if err == io.EOF {
-					return
-				} else {
+				if err != io.EOF {
 					c.lg.Errorf("read message failed: %v", err)
-					go func() { c.exit() }()
 				}
+				go func() { c.exit() }()
+				return
+			}
+
+			select {
+			case c.in <- msg:
+			case <-c.exitChan:
+				return
 			}
-			c.in <- msg
 		}
 	}
 }
 
 func (c *Control) writer() {
-	timeout := c.cfg.Server.ConnWriteTimeoutSec
-	if timeout == 0 {
-		timeout = defaultConnWriteTimeoutSec
-	}
-
 	for {
 		select {
 		case msg := <-c.out:
-			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-			if err := message.WriteMsg(c.conn, msg); err != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(getSettings().connWriteTimeout))
+			if err := c.codec.WriteMsg(c.conn, msg); err != nil {
 				c.lg.Errorf("write message failed: %v", err)
 				go func() { c.exit() }()
 			}
@@ -236,7 +511,18 @@ func (c *Control) writer() {
 	}
 }
 
+// exit shuts the control down, its tunnels are held for the client to
+// resume them if resumption is enabled.
 func (c *Control) exit() {
+	c.shutdown(true)
+}
+
+// kill shuts the control down and releases its tunnels at once.
+func (c *Control) kill() {
+	c.shutdown(false)
+}
+
+func (c *Control) shutdown(resumable bool) {
 	if !atomic.CompareAndSwapInt32(&c.isExiting, 0, 1) {
 		c.lg.Warning("control is already start exit")
 		return
@@ -246,24 +532,39 @@ func (c *Control) exit() {
 
 	close(c.exitChan)
 
-	c.waitGroup.Wait()
-
-	close(c.in)
-
-	close(c.out)
-
+	// unblock the reader
 	if err := c.conn.Close(); err != nil {
 		c.lg.Errorf("close control connection failed: %v", err)
 	}
 
-	for _, t := range c.tunnels {
-		t.exit()
+	if c.session != nil {
+		c.session.Close()
 	}
 
-	close(c.proxies)
-	for p := range c.proxies {
-		if err := p.Close(); err != nil {
-			c.lg.Errorf("close proxy connection failed: %v", err)
+	c.waitGroup.Wait()
+
+	defer close(c.exited)
+
+	tunnels := c.getTunnels()
+	if grace := getSettings().resumeGrace; resumable && grace > 0 &&
+		c.resumeToken != "" && len(tunnels) > 0 && !isDraining() {
+		c.lg.Infof("hold %d tunnels for %v to be resumed", len(tunnels), grace)
+		gResumeStore.park(c, tunnels, grace)
+	} else {
+		for _, t := range tunnels {
+			t.exit()
+		}
+	}
+
+drain:
+	for {
+		select {
+		case p := <-c.proxies:
+			if err := p.Close(); err != nil {
+				c.lg.Errorf("close proxy connection failed: %v", err)
+			}
+		default:
+			break drain
 		}
 	}
 
@@ -273,4 +574,8 @@ func (c *Control) exit() {
 func (c *Control) Replace(replacement *Control) {
 	c.lg.Info("control is replaced")
 	c.exit()
+
+	// the replacement may resume the tunnels, which are parked once the
+	// exit is done, even if it was started by a lost connection
+	<-c.exited
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+const (
+	defaultDrainTimeoutSec = 30
+
+	drainCheckInterval = 200 * time.Millisecond
+)
+
+var (
+	gDraining int32
+
+	gPublicConns = &connSet{conns: make(map[conn.IConn]int)}
+)
+
+func isDraining() bool {
+	return atomic.LoadInt32(&gDraining) == 1
+}
+
+// connSet tracks the public connections being proxied, whatever tunnel or
+// control they belong to, so they outlive the exit of their control. A
+// connection is added once per request it is serving, http/2 connections
+// serve several at once.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[conn.IConn]int
+}
+
+func (cs *connSet) add(c conn.IConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.conns[c]++
+}
+
+func (cs *connSet) remove(c conn.IConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.conns[c]--; cs.conns[c] <= 0 {
+		delete(cs.conns, c)
+	}
+}
+
+func (cs *connSet) len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return len(cs.conns)
+}
+
+// closeAll closes the public side of every connection, which ends the join
+// with its proxy.
+func (cs *connSet) closeAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for c := range cs.conns {
+		c.Close()
+	}
+}
+
+// drain stops accepting controls and public connections, tells the clients
+// to reconnect elsewhere and waits for the connections being proxied to
+// finish, those still open at the deadline are closed.
+func (s *Server) drain() {
+	atomic.StoreInt32(&gDraining, 1)
+
+	timeout := getSettings().drainTimeout
+
+	deadline := time.Now().Add(timeout)
+
+	if err := s.listener.Close(); err != nil {
+		s.Errorf("close tunnel listener failed: %v", err)
+	}
+
+	for name, l := range gListeners {
+		if err := l.Close(); err != nil {
+			s.Errorf("close %s listener failed: %v", name, err)
+		}
+	}
+
+	// the idle keep-alive connections are closed now, the busy ones once
+	// their response is written, http/2 clients are told to go away
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	for _, srv := range gHttpServers {
+		go srv.Shutdown(ctx)
+	}
+
+	for _, t := range gTunnelRegistry.All() {
+		t.stopAccepting()
+	}
+
+	for _, ctl := range gControlRegistry.All() {
+		ctl.drain(timeout)
+	}
+
+	s.Infof("draining %d connections, waiting up to %v", gPublicConns.len(), timeout)
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for gPublicConns.len() > 0 {
+		if time.Now().After(deadline) {
+			s.Warningf("drain timeout, closing %d connections", gPublicConns.len())
+			gPublicConns.closeAll()
+			return
+		}
+		<-ticker.C
+	}
+
+	s.Info("drained all connections")
+}
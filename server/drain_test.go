@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+	"github.com/tianhongw/grp/pkg/log"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+// newTestDrainServer returns a server with a tunnel listener and an http
+// server, draining within timeout.
+func newTestDrainServer(t *testing.T, timeout time.Duration) (*Server, chan error) {
+	t.Helper()
+
+	initTestConfig(t)
+	setTestGlobals(t, &settings{drainTimeout: timeout})
+
+	listeners, httpServers := gListeners, gHttpServers
+	t.Cleanup(func() { gListeners, gHttpServers = listeners, httpServers })
+
+	tunnelListener, err := conn.Listen("127.0.0.1:0", "tunnel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tunnelListener.Close() })
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: http.NotFoundHandler()}
+	served := make(chan error, 1)
+	go func() { served <- httpServer.Serve(httpListener) }()
+	t.Cleanup(func() { httpServer.Close() })
+
+	gListeners = map[string]*conn.Listener{}
+	gHttpServers = map[string]*http.Server{"http": httpServer}
+
+	return &Server{Logger: log.DummyLogger, listener: tunnelListener}, served
+}
+
+// addPublicConn tracks a public connection being proxied and returns its
+// remote end.
+func addPublicConn(t *testing.T) (*testConn, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	c := &testConn{Conn: server}
+	gPublicConns.add(c)
+
+	return c, client
+}
+
+// isClosed reports whether the end of a pipe was closed by the other one.
+func isClosed(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+
+	return err == io.EOF
+}
+
+func runDrain(s *Server) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.drain()
+		close(done)
+	}()
+
+	return done
+}
+
+func TestDrain(t *testing.T) {
+	s, served := newTestDrainServer(t, 10*time.Second)
+
+	c, _ := newTestControl(t, "c1", "alice")
+	c.version = drainProtocolVersion
+	old, _ := newTestControl(t, "c2", "bob")
+
+	tunnel := addTestTunnel(t, c, "tcp://nrp.me:1", &message.TunnelRequest{Protocol: "tcp"})
+	tunnelListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.listener = tunnelListener
+
+	pub, remote := addPublicConn(t)
+
+	start := time.Now()
+	done := runDrain(s)
+
+	// clients that know of draining are told the deadline, older ones not
+	select {
+	case msg := <-c.out:
+		if drain, ok := msg.(*message.Drain); !ok || drain.DeadlineSec != 10 {
+			t.Errorf("sent %+v, want a drain of 10s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drain sent to the client")
+	}
+	select {
+	case msg := <-old.out:
+		t.Errorf("sent %+v to a client of an older version", msg)
+	default:
+	}
+
+	if !isDraining() {
+		t.Error("not draining")
+	}
+
+	// nothing new is accepted
+	if _, ok := <-s.listener.Conns; ok {
+		t.Error("the tunnel listener accepts controls")
+	}
+	if _, err := tunnelListener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Error("the tunnel accepts public connections")
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("http server: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the http server was not shut down")
+	}
+
+	// the connection being proxied is waited for
+	select {
+	case <-done:
+		t.Fatal("drained with a connection open")
+	case <-time.After(3 * drainCheckInterval):
+	}
+	if isClosed(remote) {
+		t.Fatal("the connection was closed before the deadline")
+	}
+
+	gPublicConns.remove(pub)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained once the connections finished")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drained in %v, before the deadline of 10s", elapsed)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	timeout := 500 * time.Millisecond
+	s, _ := newTestDrainServer(t, timeout)
+
+	// a connection counted twice, as an http/2 one serving two requests
+	pub, remote := addPublicConn(t)
+	gPublicConns.add(pub)
+	_, other := addPublicConn(t)
+
+	start := time.Now()
+	done := runDrain(s)
+
+	select {
+	case <-done:
+	case <-time.After(timeout + 5*time.Second):
+		t.Fatal("drain did not end at the deadline")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("drain ended after %v, before the deadline of %v", elapsed, timeout)
+	}
+
+	// the connections still open at the deadline are closed
+	for i, c := range []net.Conn{remote, other} {
+		if !isClosed(c) {
+			t.Errorf("connection %d still open after the deadline", i)
+		}
+	}
+}
+
+func TestConnSet(t *testing.T) {
+	cs := &connSet{conns: make(map[conn.IConn]int)}
+	a, b := &testConn{}, &testConn{}
+
+	cs.add(a)
+	cs.add(a)
+	cs.add(b)
+	if n := cs.len(); n != 2 {
+		t.Fatalf("%d connections, want 2", n)
+	}
+
+	// a connection stays until every request on it is done
+	cs.remove(a)
+	if n := cs.len(); n != 2 {
+		t.Errorf("%d connections after a request of a finished, want 2", n)
+	}
+	cs.remove(a)
+	cs.remove(b)
+	if n := cs.len(); n != 0 {
+		t.Errorf("%d connections after all finished, want 0", n)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// load balancing strategies of tunnel groups
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceRandom     = "random"
+)
+
+// tunnelGroup holds the tunnels registered for one url, a single tunnel
+// unless the tunnels joined a named group to share the url.
+type tunnelGroup struct {
+	name    string
+	balance string
+
+	// guarded by the registry lock
+	members []*Tunnel
+
+	next uint64
+}
+
+func newTunnelGroup(t *Tunnel) *tunnelGroup {
+	return &tunnelGroup{
+		name:    t.req.Group,
+		balance: t.req.Balance,
+		members: []*Tunnel{t},
+	}
+}
+
+func checkBalance(balance string) error {
+	switch balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceRandom:
+		return nil
+	default:
+		return fmt.Errorf("unsupported balance strategy: %s", balance)
+	}
+}
+
+// owner returns a member standing for the owner of the url.
+func (g *tunnelGroup) owner() *Tunnel {
+	return g.members[0]
+}
+
+// canJoin reports why t may not join the group, members must ask for the
+// same group and belong to the same user, or to the same client if they
+// have no user.
+func (g *tunnelGroup) canJoin(t *Tunnel) error {
+	if g.name == "" || t.req.Group != g.name {
+		return fmt.Errorf("tunnel: %s is already registered", t.url)
+	}
+
+	if !sameOwner(t, g.owner()) {
+		return fmt.Errorf("group: %s of tunnel: %s belongs to another user", g.name, t.url)
+	}
+
+	return nil
+}
+
+func (g *tunnelGroup) remove(t *Tunnel) {
+	for i, m := range g.members {
+		if m == t {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// pick returns the member serving the next public connection.
+func (g *tunnelGroup) pick() *Tunnel {
+	members := g.available()
+	if len(members) == 1 {
+		return members[0]
+	}
+
+	switch g.balance {
+	case BalanceLeastConn:
+		best := members[0]
+		for _, m := range members[1:] {
+			if m.activeConns() < best.activeConns() {
+				best = m
+			}
+		}
+		return best
+	case BalanceRandom:
+		return members[rand.Intn(len(members))]
+	default:
+		n := atomic.AddUint64(&g.next, 1)
+		return members[(n-1)%uint64(len(members))]
+	}
+}
+
+// available returns the members whose client is connected, parked members
+// only get public connections if all members are parked.
+func (g *tunnelGroup) available() []*Tunnel {
+	parked := 0
+	for _, m := range g.members {
+		if m.isParked() {
+			parked++
+		}
+	}
+
+	if parked == 0 || parked == len(g.members) {
+		return g.members
+	}
+
+	members := make([]*Tunnel, 0, len(g.members)-parked)
+	for _, m := range g.members {
+		if !m.isParked() {
+			members = append(members, m)
+		}
+	}
+
+	return members
+}
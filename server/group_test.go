@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+func newTestGroup(balance string, n int) *tunnelGroup {
+	url := "http://g.nrp.me:80"
+
+	g := newTunnelGroup(newTestTunnel("alice", url))
+	g.balance = balance
+	for i := 1; i < n; i++ {
+		g.members = append(g.members, newTestTunnel("alice", url))
+	}
+
+	return g
+}
+
+func TestGroupPickSkipsParked(t *testing.T) {
+	for _, balance := range []string{BalanceRoundRobin, BalanceLeastConn, BalanceRandom} {
+		g := newTestGroup(balance, 3)
+		atomic.StoreInt32(&g.members[0].parked, 1)
+		atomic.StoreInt32(&g.members[2].parked, 1)
+		// the least loaded member is parked
+		atomic.StoreInt64(&g.members[1].conns, 10)
+
+		for i := 0; i < 10; i++ {
+			if m := g.pick(); m != g.members[1] {
+				t.Fatalf("%s picked a parked member", balance)
+			}
+		}
+	}
+}
+
+func TestGroupPickAllParked(t *testing.T) {
+	g := newTestGroup(BalanceRoundRobin, 2)
+	for _, m := range g.members {
+		atomic.StoreInt32(&m.parked, 1)
+	}
+
+	if g.pick() == nil {
+		t.Fatal("no member picked")
+	}
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	g := newTestGroup(BalanceRoundRobin, 3)
+
+	picked := make(map[*Tunnel]int)
+	for i := 0; i < 9; i++ {
+		picked[g.pick()]++
+	}
+
+	for i, m := range g.members {
+		if picked[m] != 3 {
+			t.Errorf("member %d picked %d times, want 3", i, picked[m])
+		}
+	}
+
+	// a resumed member is picked again
+	atomic.StoreInt32(&g.members[0].parked, 1)
+	for i := 0; i < 4; i++ {
+		if g.pick() == g.members[0] {
+			t.Fatal("parked member picked")
+		}
+	}
+
+	atomic.StoreInt32(&g.members[0].parked, 0)
+	picked = make(map[*Tunnel]int)
+	for i := 0; i < 3; i++ {
+		picked[g.pick()]++
+	}
+	if picked[g.members[0]] != 1 {
+		t.Errorf("resumed member picked %d times, want 1", picked[g.members[0]])
+	}
+}
+
+func TestGroupCanJoin(t *testing.T) {
+	url := "http://g.nrp.me:80"
+
+	member := func(ctl *Control, group string) *Tunnel {
+		return &Tunnel{req: &message.TunnelRequest{Group: group}, url: url, ctl: ctl}
+	}
+
+	alice := &Control{clientId: "a1", user: "alice"}
+	anonymous := &Control{clientId: "x1"}
+
+	tests := []struct {
+		name  string
+		owner *Tunnel
+		t     *Tunnel
+		ok    bool
+	}{
+		{"same user", member(alice, "web"), member(&Control{clientId: "a2", user: "alice"}, "web"), true},
+		{"another user", member(alice, "web"), member(&Control{clientId: "b1", user: "bob"}, "web"), false},
+		{"another group", member(alice, "web"), member(alice, "api"), false},
+		{"no group", member(alice, ""), member(alice, ""), false},
+		// anonymous clients only join their own groups
+		{"anonymous owner", member(anonymous, "web"), member(anonymous, "web"), true},
+		{"anonymous stranger", member(anonymous, "web"), member(&Control{clientId: "x2"}, "web"), false},
+		{"anonymous to a user", member(alice, "web"), member(&Control{clientId: "x2"}, "web"), false},
+		{"user to an anonymous", member(anonymous, "web"), member(alice, "web"), false},
+	}
+
+	for _, tt := range tests {
+		err := newTunnelGroup(tt.owner).canJoin(tt.t)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok: %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+// headerRules rewrite the headers of every request forwarded to an http
+// tunnel.
+type headerRules struct {
+	xForwarded bool
+
+	remove []string
+	set    map[string]string
+	add    map[string]string
+
+	host string
+}
+
+// newHeaderRules returns the rules asked for by req, nil if there are none.
+func newHeaderRules(req *message.TunnelRequest) *headerRules {
+	if !req.XForwarded && len(req.RemoveHeaders) == 0 && len(req.SetHeaders) == 0 &&
+		len(req.AddHeaders) == 0 && req.HostHeader == "" {
+		return nil
+	}
+
+	return &headerRules{
+		xForwarded: req.XForwarded,
+		remove:     req.RemoveHeaders,
+		set:        req.SetHeaders,
+		add:        req.AddHeaders,
+		host:       strings.TrimSpace(req.HostHeader),
+	}
+}
+
+// setForwardedFor appends the address of the client to X-Forwarded-For, as
+// any reverse proxy does, whether the tunnel has header rules or not.
+func setForwardedFor(r *http.Request, remoteAddr string) {
+	clientIP := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		clientIP = host
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+
+	r.Header.Set("X-Forwarded-For", clientIP)
+}
+
+// validate reports rules the forwarded requests wouldn't follow, the Host
+// of a request isn't one of its headers.
+func (hr *headerRules) validate() error {
+	for _, name := range hr.remove {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			return errors.New("the Host header can not be removed")
+		}
+	}
+
+	for _, rules := range []map[string]string{hr.set, hr.add} {
+		for name := range rules {
+			if http.CanonicalHeaderKey(name) == "Host" {
+				return errors.New("the Host header can only be replaced by the host header rule")
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply rewrites the headers of r received over proto, which carry
+// X-Forwarded-For already. The other forwarded headers are set first so
+// the rules of the tunnel can still remove or override them all.
+func (hr *headerRules) apply(r *http.Request, proto string) {
+	if hr.xForwarded {
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	for _, name := range hr.remove {
+		r.Header.Del(name)
+	}
+
+	for name, value := range hr.set {
+		r.Header.Set(name, value)
+	}
+
+	for name, value := range hr.add {
+		r.Header.Add(name, value)
+	}
+
+	if hr.host != "" {
+		r.Host = hr.host
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tianhongw/grp/pkg/log"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+func newTestRequest(header http.Header) *http.Request {
+	r, _ := http.NewRequest("GET", "http://web.nrp.me/", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	return r
+}
+
+func TestSetForwardedFor(t *testing.T) {
+	tests := []struct {
+		prior      []string
+		remoteAddr string
+		want       string
+	}{
+		{nil, "1.2.3.4:5678", "1.2.3.4"},
+		{nil, "[::1]:5678", "::1"},
+		{[]string{"10.0.0.1"}, "1.2.3.4:5678", "10.0.0.1, 1.2.3.4"},
+		{[]string{"10.0.0.1", "10.0.0.2"}, "1.2.3.4:5678", "10.0.0.1, 10.0.0.2, 1.2.3.4"},
+	}
+
+	for _, tt := range tests {
+		r := newTestRequest(http.Header{"X-Forwarded-For": tt.prior})
+		setForwardedFor(r, tt.remoteAddr)
+		if got := r.Header.Values("X-Forwarded-For"); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%v from %s: %v, want %s", tt.prior, tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	header := http.Header{
+		"X-Forwarded-For": {"1.2.3.4"},
+		"Cookie":          {"a=1"},
+		"X-Env":           {"prod"},
+		"Via":             {"cdn"},
+	}
+
+	tests := []struct {
+		name string
+		req  *message.TunnelRequest
+		want http.Header
+		host string
+	}{
+		{
+			name: "forwarded",
+			req:  &message.TunnelRequest{XForwarded: true},
+			want: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"web.nrp.me"},
+				"Cookie":            {"a=1"},
+				"X-Env":             {"prod"},
+				"Via":               {"cdn"},
+			},
+		},
+		{
+			// the forwarded headers are set before the rules apply
+			name: "forwarded overridden",
+			req: &message.TunnelRequest{
+				XForwarded:    true,
+				RemoveHeaders: []string{"x-forwarded-for", "X-Forwarded-Host"},
+				SetHeaders:    map[string]string{"X-Forwarded-Proto": "http"},
+			},
+			want: http.Header{
+				"X-Forwarded-Proto": {"http"},
+				"Cookie":            {"a=1"},
+				"X-Env":             {"prod"},
+				"Via":               {"cdn"},
+			},
+		},
+		{
+			// headers are removed, then set, then added
+			name: "remove set add",
+			req: &message.TunnelRequest{
+				RemoveHeaders: []string{"Cookie", "X-Env", "Via"},
+				SetHeaders:    map[string]string{"X-Env": "staging"},
+				AddHeaders:    map[string]string{"x-env": "eu", "Via": "nrp"},
+			},
+			want: http.Header{
+				"X-Forwarded-For": {"1.2.3.4"},
+				"X-Env":           {"staging", "eu"},
+				"Via":             {"nrp"},
+			},
+		},
+		{
+			name: "set and add to kept",
+			req: &message.TunnelRequest{
+				SetHeaders: map[string]string{"X-Env": "staging"},
+				AddHeaders: map[string]string{"Via": "nrp"},
+			},
+			want: http.Header{
+				"X-Forwarded-For": {"1.2.3.4"},
+				"Cookie":          {"a=1"},
+				"X-Env":           {"staging"},
+				"Via":             {"cdn", "nrp"},
+			},
+		},
+		{
+			name: "host",
+			req:  &message.TunnelRequest{HostHeader: " localhost:8080 "},
+			want: header,
+			host: "localhost:8080",
+		},
+	}
+
+	for _, tt := range tests {
+		r := newTestRequest(header.Clone())
+		newHeaderRules(tt.req).apply(r, "https")
+
+		if !reflect.DeepEqual(r.Header, tt.want) {
+			t.Errorf("%s: header %v, want %v", tt.name, r.Header, tt.want)
+		}
+		host := tt.host
+		if host == "" {
+			host = "web.nrp.me"
+		}
+		if r.Host != host {
+			t.Errorf("%s: host %s, want %s", tt.name, r.Host, host)
+		}
+	}
+
+	if rules := newHeaderRules(&message.TunnelRequest{Protocol: "http"}); rules != nil {
+		t.Errorf("rules of a request without any: %+v", rules)
+	}
+}
+
+func TestHeaderRulesHost(t *testing.T) {
+	refused := []*message.TunnelRequest{
+		{SetHeaders: map[string]string{"host": "localhost"}},
+		{AddHeaders: map[string]string{"Host": "localhost"}},
+		{RemoveHeaders: []string{"HOST"}},
+	}
+
+	ctl := &Control{lg: log.DummyLogger}
+	for _, req := range refused {
+		req.Protocol = "http"
+		if err := newHeaderRules(req).validate(); err == nil || !strings.Contains(err.Error(), "Host") {
+			t.Errorf("%+v: %v", req, err)
+		}
+		// before anything is registered
+		if _, err := NewTunnel(req, ctl, testConfig); err == nil {
+			t.Errorf("tunnel of %+v: no error", req)
+		}
+	}
+
+	ok := &message.TunnelRequest{
+		HostHeader:    "localhost",
+		SetHeaders:    map[string]string{"X-Forwarded-Host": "web.nrp.me"},
+		RemoveHeaders: []string{"X-Host"},
+	}
+	if err := newHeaderRules(ok).validate(); err != nil {
+		t.Errorf("%+v: %v", ok, err)
+	}
+}
@@ -1,19 +1,35 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/inconshreveable/go-vhost"
 	"github.com/tianhongw/grp/pkg/conn"
+	"golang.org/x/net/http2"
 )
 
-func startHttpListener(addr string, tlsCfg *tls.Config) (*conn.Listener, error) {
+type publicConnKey struct{}
+
+// startHttpListener serves the public http or https connections, every
+// request is routed to the tunnel of its host and path on its own. The https
+// clients may negotiate http/2, whatever the local services speak.
+func startHttpListener(addr string, tlsCfg *tls.Config) (*conn.Listener, *http.Server, error) {
+	if tlsCfg != nil {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
 	listener, err := conn.Listen(addr, "public", tlsCfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	proto := "http"
@@ -21,50 +37,340 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (*conn.Listener, error)
 		proto = "https"
 	}
 
-	go func() {
-		for conn := range listener.Conns {
-			go httpHandle(conn, proto)
+	srv := &http.Server{
+		Handler:           &httpProxy{proto: proto},
+		ReadHeaderTimeout: defaultConnReadTimeoutSec * time.Second,
+		IdleTimeout:       defaultProxyConnTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, publicConnKey{}, c)
+		},
+	}
+
+	l := &httpListener{
+		Listener: listener,
+		proto:    proto,
+		srv:      srv,
+		conns:    make(chan *publicConn),
+		done:     make(chan struct{}),
+	}
+
+	if tlsCfg != nil {
+		l.h2 = &http2.Server{}
+		// shutting srv down sends the http/2 clients a GOAWAY
+		if err := http2.ConfigureServer(srv, l.h2); err != nil {
+			listener.Close()
+			return nil, nil, err
 		}
-	}()
+	}
 
-	return listener, nil
+	go l.run()
+	go srv.Serve(l)
+
+	return listener, srv, nil
 }
 
-func httpHandle(c conn.IConn, proto string) {
-	defer c.Close()
+// handshaker is a connection accepted by a tls listener.
+type handshaker interface {
+	Handshake() (string, error)
+}
 
-	c.SetDeadline(time.Now().Add(defaultConnReadTimeoutSec * time.Second))
+// httpListener hands the connections of a public listener to net/http, but
+// those negotiating http/2 which it serves itself.
+type httpListener struct {
+	*conn.Listener
 
-	vhostConn, err := vhost.HTTP(c)
-	if err != nil {
-		c.Errorf("bad request: %v", err)
-		c.Write([]byte(conn.BadRequest))
-		return
+	proto string
+
+	srv *http.Server
+
+	// https only
+	h2 *http2.Server
+
+	// http/1.x connections ready for srv
+	conns chan *publicConn
+	// closed once the listener is closed
+	done chan struct{}
+}
+
+func (l *httpListener) run() {
+	defer close(l.done)
+
+	for c := range l.Conns {
+		metricPublicConns.Inc(l.proto)
+		go l.serve(&publicConn{IConn: c})
 	}
+}
+
+func (l *httpListener) serve(c *publicConn) {
+	if l.h2 != nil {
+		c.SetDeadline(time.Now().Add(defaultConnReadTimeoutSec * time.Second))
 
-	host := strings.ToLower(vhostConn.Host())
+		proto, err := c.IConn.(handshaker).Handshake()
+		if err != nil {
+			c.Debugf("tls handshake failed: %v", err)
+			c.Close()
+			return
+		}
 
-	auth := vhostConn.Request.Header.Get("Authorization")
+		c.SetDeadline(time.Time{})
 
-	vhostConn.Free()
+		if proto == http2.NextProtoTLS {
+			l.h2.ServeConn(c, &http2.ServeConnOpts{
+				Context:    context.WithValue(context.Background(), publicConnKey{}, c),
+				BaseConfig: l.srv,
+			})
+			return
+		}
+	}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *httpListener) Addr() net.Addr {
+	return l.Listener.Addr
+}
+
+// roundTripper forwards requests over proxy connections.
+type roundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+type transportKey struct {
+	t   *Tunnel
+	h2c bool
+}
+
+// publicConn is a connection of the public http listener. The requests it
+// carries keep proxy connections open to the tunnels they are routed to,
+// one per request in flight, they are all closed with it.
+type publicConn struct {
+	conn.IConn
+
+	mu sync.Mutex
+	// dropped once the connection is closed
+	transports map[transportKey]roundTripper
+	proxyConns map[*publicProxyConn]struct{}
+	closed     bool
+}
+
+// publicProxyConn is a proxy connection dialed for the requests of pc.
+type publicProxyConn struct {
+	*countedProxyConn
+
+	pc        *publicConn
+	closeOnce sync.Once
+}
+
+func (c *publicProxyConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.pc.mu.Lock()
+		delete(c.pc.proxyConns, c)
+		c.pc.mu.Unlock()
+
+		err = c.countedProxyConn.Close()
+	})
+
+	return err
+}
+
+// addProxyConn tracks proxyConn until either side is closed, it fails if
+// the public connection is already closed.
+func (c *publicConn) addProxyConn(t *Tunnel, proxyConn conn.IConn) (net.Conn, error) {
+	pConn := &publicProxyConn{
+		countedProxyConn: &countedProxyConn{IConn: proxyConn, url: t.url, proto: t.req.Protocol},
+		pc:               c,
+	}
 
-	c = conn.WrapConn(c, "public")
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	tunnel := gTunnelRegistry.Get(fmt.Sprintf("%s://%s", proto, host))
+	if c.closed {
+		proxyConn.Close()
+		return nil, net.ErrClosed
+	}
+
+	if c.proxyConns == nil {
+		c.proxyConns = make(map[*publicProxyConn]struct{})
+	}
+	c.proxyConns[pConn] = struct{}{}
+
+	return pConn, nil
+}
+
+// transport returns the transport of the requests to t, http/1.1 unless
+// the local service speaks h2c. Upgrades don't exist in http/2, they are
+// always sent over http/1.1.
+func (c *publicConn) transport(t *Tunnel, upgrade bool) roundTripper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := transportKey{t: t, h2c: t.req.H2C && !upgrade}
+
+	if tr, ok := c.transports[key]; ok {
+		return tr
+	}
+
+	dial := func() (net.Conn, error) {
+		proxyConn, err := t.dialProxy(c.RemoteAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		return c.addProxyConn(t, proxyConn)
+	}
+
+	// the responses are passed on as sent by the local service, so neither
+	// transport asks for compression
+	var tr roundTripper
+	if key.h2c {
+		tr = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial()
+			},
+			DisableCompression: true,
+		}
+	} else {
+		tr = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial()
+			},
+			DisableCompression:  true,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     defaultProxyConnTimeout,
+		}
+	}
+
+	// a request racing with the close doesn't keep its transport
+	if !c.closed {
+		if c.transports == nil {
+			c.transports = make(map[transportKey]roundTripper)
+		}
+		c.transports[key] = tr
+	}
+
+	return tr
+}
+
+// Close closes the proxy connections too, busy ones included since the
+// requests they carry can't be answered anymore.
+func (c *publicConn) Close() error {
+	c.mu.Lock()
+	transports := c.transports
+	c.transports = nil
+	proxyConns := c.proxyConns
+	c.proxyConns = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, tr := range transports {
+		tr.CloseIdleConnections()
+	}
+
+	for pConn := range proxyConns {
+		pConn.Close()
+	}
+
+	return c.IConn.Close()
+}
+
+// httpProxy forwards the requests of the public listener to the tunnels.
+type httpProxy struct {
+	proto string
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(publicConnKey{}).(*publicConn)
+
+	host := strings.ToLower(r.Host)
+
+	tunnel := gTunnelRegistry.Lookup(p.proto, host, r.URL.Path)
 	if tunnel == nil {
 		c.Errorf("can not find tunnel for host: %s", host)
-		c.Write([]byte(fmt.Sprintf(conn.NotFound, len(host)+8, host)))
+		metricVhostNotFound.Inc(p.proto)
+		http.Error(w, fmt.Sprintf("Tunnel %s not found", host), http.StatusNotFound)
 		return
 	}
 
 	if tunnel.req.HttpAuth != "" &&
-		tunnel.req.HttpAuth != auth {
+		tunnel.req.HttpAuth != r.Header.Get("Authorization") {
 		c.Error("authentication failed")
-		c.Write([]byte(conn.NotAuthorized))
+		w.Header().Set("WWW-Authenticate", `Basic realm="ngrok"`)
+		http.Error(w, "Authorization required", http.StatusUnauthorized)
 		return
 	}
 
-	c.SetDeadline(time.Time{})
+	atomic.AddInt64(&tunnel.conns, 1)
+	defer atomic.AddInt64(&tunnel.conns, -1)
+
+	gPublicConns.add(c)
+	defer gPublicConns.remove(c)
+
+	metricHttpRequests.Inc(tunnel.url, tunnel.req.Protocol)
+
+	status := http.StatusBadGateway
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			p.rewrite(req, tunnel, c.RemoteAddr().String())
+		},
+		Transport: c.transport(tunnel, r.Header.Get("Upgrade") != ""),
+		// pass every write of the local service on right away, like
+		// streamed responses
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			status = resp.StatusCode
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			c.Errorf("proxy request to tunnel: %s failed: %v", tunnel.url, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	// X-Forwarded-For is set before the header rules of the tunnel, which
+	// may remove or override it, an empty remote address keeps the proxy
+	// from appending to it after them
+	r.RemoteAddr = ""
+
+	start := time.Now()
+
+	proxy.ServeHTTP(w, r)
+
+	c.Infof("%s %s%s %d %v -> %s", r.Method, r.Host, r.URL.RequestURI(), status,
+		time.Since(start), tunnel.url)
+}
+
+// rewrite prepares req for the local service of t, it removes the path
+// prefix if asked to, sets X-Forwarded-For and applies the header rules of
+// the tunnel.
+func (p *httpProxy) rewrite(req *http.Request, t *Tunnel, remoteAddr string) {
+	// the host only keys the proxy connections, they all go to the tunnel
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+
+	if t.req.StripPrefix && t.pathPrefix != "" && strings.HasPrefix(req.URL.Path, t.pathPrefix) {
+		req.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, t.pathPrefix), "/")
+		req.URL.RawPath = ""
+	}
+
+	setForwardedFor(req, remoteAddr)
 
-	tunnel.handlePublicConn(c)
+	if t.headers != nil {
+		t.headers.apply(req, p.proto)
+	}
 }
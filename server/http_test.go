@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/message"
+	"golang.org/x/net/http2"
+)
+
+// oneConnListener accepts c, then nothing.
+type oneConnListener struct {
+	c net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if c := l.c; c != nil {
+		l.c = nil
+		return c, nil
+	}
+
+	return nil, io.EOF
+}
+
+func (l *oneConnListener) Close() error { return nil }
+
+func (l *oneConnListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+// serveTestClient plays the client of c, it answers the proxy requests with
+// connections on which handler serves the local service, over h2c if asked
+// to. The url of the tunnel is passed to handler as X-Tunnel.
+func serveTestClient(t *testing.T, c *Control, h2c bool, handler http.Handler) {
+	t.Helper()
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	serve := func(proxy *testConn) {
+		msg, err := message.ReadMsg(proxy)
+		if err != nil {
+			proxy.Close()
+			return
+		}
+		url := msg.(*message.ProxyStart).URL
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Tunnel", url)
+			handler.ServeHTTP(w, r)
+		})
+
+		if h2c {
+			(&http2.Server{}).ServeConn(proxy, &http2.ServeConnOpts{Handler: h})
+			return
+		}
+
+		// the connection is served on after Serve returns
+		(&http.Server{Handler: h}).Serve(&oneConnListener{c: proxy})
+	}
+
+	go func() {
+		for {
+			select {
+			case msg := <-c.out:
+				if _, ok := msg.(*message.ProxyRequest); ok {
+					server, client := net.Pipe()
+					t.Cleanup(func() { client.Close() })
+					c.proxies <- &testConn{Conn: server}
+					go serve(&testConn{Conn: client})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// startTestHttpListener starts a public listener, an https one serving
+// cert if it is set.
+func startTestHttpListener(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	var tlsCfg *tls.Config
+	if cert != nil {
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+
+	l, srv, err := startHttpListener("127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		srv.Close()
+	})
+
+	return l.Addr.String()
+}
+
+// echoHandler answers with what the local service received.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Tunnel", r.Header.Get("X-Tunnel"))
+	w.Header().Set("X-Proto", r.Proto)
+	fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"))
+})
+
+func TestHttpProxy(t *testing.T) {
+	initTestConfig(t)
+	setTestGlobals(t, &settings{})
+
+	addr := startTestHttpListener(t, nil)
+
+	c, _ := newTestControl(t, "c1", "alice")
+	serveTestClient(t, c, false, echoHandler)
+
+	web := addTestTunnel(t, c, "http://web.nrp.me", nil)
+	api := addTestTunnel(t, c, "http://web.nrp.me/api", &message.TunnelRequest{Protocol: "http", StripPrefix: true})
+	api.pathPrefix = "/api"
+	docs := addTestTunnel(t, c, "http://web.nrp.me/docs", nil)
+	docs.pathPrefix = "/docs"
+	private := addTestTunnel(t, c, "http://private.nrp.me",
+		&message.TunnelRequest{Protocol: "http", HttpAuth: "Basic dXNlcjpwYXNz"})
+	anonymous := addTestTunnel(t, c, "http://anonymous.nrp.me", nil)
+	anonymous.headers = newHeaderRules(&message.TunnelRequest{RemoveHeaders: []string{"X-Forwarded-For"}})
+
+	tests := []struct {
+		host   string
+		path   string
+		auth   string
+		xff    string
+		status int
+		tunnel *Tunnel
+		body   string
+	}{
+		{"web.nrp.me", "/x?a=1", "", "", 200, web, "GET /x?a=1 127.0.0.1"},
+		{"WEB.nrp.me", "/", "", "", 200, web, "GET / 127.0.0.1"},
+		// the prefix is removed at a segment boundary only
+		{"web.nrp.me", "/api/items?id=1", "", "", 200, api, "GET /items?id=1 127.0.0.1"},
+		{"web.nrp.me", "/api", "", "", 200, api, "GET / 127.0.0.1"},
+		{"web.nrp.me", "/api//x", "", "", 200, api, "GET /x 127.0.0.1"},
+		{"web.nrp.me", "/apix", "", "", 200, web, "GET /apix 127.0.0.1"},
+		// or not at all
+		{"web.nrp.me", "/docs/a", "", "", 200, docs, "GET /docs/a 127.0.0.1"},
+		{"private.nrp.me", "/", "Basic dXNlcjpwYXNz", "", 200, private, "GET / 127.0.0.1"},
+		{"private.nrp.me", "/", "", "", 401, nil, ""},
+		{"private.nrp.me", "/", "Basic d3Jvbmc6cGFzcw==", "", 401, nil, ""},
+		{"unknown.nrp.me", "/", "", "", 404, nil, ""},
+		// the address of the client is forwarded unless the rules remove it
+		{"web.nrp.me", "/", "", "10.0.0.1", 200, web, "GET / 10.0.0.1, 127.0.0.1"},
+		{"anonymous.nrp.me", "/", "", "10.0.0.1", 200, anonymous, "GET / "},
+	}
+
+	// every request of a keep-alive connection is routed on its own
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+
+	for _, tt := range tests {
+		name := tt.host + tt.path
+
+		req, _ := http.NewRequest("GET", "http://"+addr+tt.path, nil)
+		req.Host = tt.host
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", name, resp.StatusCode, tt.status)
+			continue
+		}
+
+		switch tt.status {
+		case 200:
+			if got := resp.Header.Get("X-Tunnel"); got != tt.tunnel.url {
+				t.Errorf("%s: routed to %s, want %s", name, got, tt.tunnel.url)
+			}
+			if string(body) != tt.body {
+				t.Errorf("%s: local service received %q, want %q", name, body, tt.body)
+			}
+		case 401:
+			if got := resp.Header.Get("WWW-Authenticate"); got != `Basic realm="ngrok"` {
+				t.Errorf("%s: WWW-Authenticate %q", name, got)
+			}
+		}
+		if tt.status != 200 && resp.Header.Get("X-Tunnel") != "" {
+			t.Errorf("%s: forwarded to the tunnel", name)
+		}
+	}
+}
+
+func TestHttpProxyH2(t *testing.T) {
+	initTestConfig(t)
+	setTestGlobals(t, &settings{})
+
+	// the certificate of httptest is valid for example.com and its sub domains
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	defer certSrv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certSrv.Certificate())
+
+	addr := startTestHttpListener(t, &certSrv.TLS.Certificates[0])
+
+	c1, _ := newTestControl(t, "c1", "alice")
+	serveTestClient(t, c1, false, echoHandler)
+	web := addTestTunnel(t, c1, "https://web.example.com", &message.TunnelRequest{Protocol: "https"})
+
+	c2, _ := newTestControl(t, "c2", "alice")
+	serveTestClient(t, c2, true, echoHandler)
+	grpc := addTestTunnel(t, c2, "https://grpc.example.com", &message.TunnelRequest{Protocol: "https", H2C: true})
+
+	h2 := &http.Client{
+		Transport: &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   5 * time.Second,
+	}
+	h1 := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   5 * time.Second,
+	}
+	defer h2.CloseIdleConnections()
+	defer h1.CloseIdleConnections()
+
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	h2.Transport.(*http2.Transport).DialTLS = func(network, host string, cfg *tls.Config) (net.Conn, error) {
+		raw, err := dial(context.Background(), network, host)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(raw, cfg), nil
+	}
+	h1.Transport.(*http.Transport).DialContext = dial
+
+	tests := []struct {
+		client    *http.Client
+		host      string
+		tunnel    *Tunnel
+		publicIn  string
+		forwarded string
+	}{
+		// http/2 ends at the server, whatever the local service speaks
+		{h2, "web.example.com", web, "HTTP/2.0", "HTTP/1.1"},
+		{h2, "grpc.example.com", grpc, "HTTP/2.0", "HTTP/2.0"},
+		{h1, "web.example.com", web, "HTTP/1.1", "HTTP/1.1"},
+		// the local service speaking h2c gets http/1.1 requests over it
+		{h1, "grpc.example.com", grpc, "HTTP/1.1", "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		name := tt.publicIn + " " + tt.host
+
+		// streams of a connection are routed on their own
+		for i := 0; i < 2; i++ {
+			resp, err := tt.client.Get("https://" + tt.host + "/x")
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.Proto != tt.publicIn {
+				t.Errorf("%s: %s %d", name, resp.Proto, resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Tunnel"); got != tt.tunnel.url {
+				t.Errorf("%s: routed to %s, want %s", name, got, tt.tunnel.url)
+			}
+			if got := resp.Header.Get("X-Proto"); got != tt.forwarded {
+				t.Errorf("%s: forwarded over %s, want %s", name, got, tt.forwarded)
+			}
+			if string(body) != "GET /x 127.0.0.1" {
+				t.Errorf("%s: local service received %q", name, body)
+			}
+		}
+	}
+}
+
+func TestPublicConnTransport(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c := &publicConn{IConn: &testConn{Conn: server}}
+	plain := &Tunnel{req: &message.TunnelRequest{Protocol: "http"}}
+	h2c := &Tunnel{req: &message.TunnelRequest{Protocol: "http", H2C: true}}
+
+	if _, ok := c.transport(plain, false).(*http.Transport); !ok {
+		t.Error("http/1.1 tunnel: not an http/1.1 transport")
+	}
+	if _, ok := c.transport(h2c, false).(*http2.Transport); !ok {
+		t.Error("h2c tunnel: not an http/2 transport")
+	}
+	// upgrades don't exist in http/2
+	if _, ok := c.transport(h2c, true).(*http.Transport); !ok {
+		t.Error("upgrade to an h2c tunnel: not an http/1.1 transport")
+	}
+
+	// the transports of a connection are kept
+	if c.transport(h2c, false) != c.transport(h2c, false) {
+		t.Error("a new transport for every request")
+	}
+	c.Close()
+	if c.transports != nil {
+		t.Error("transports kept after the close")
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+	"github.com/tianhongw/grp/pkg/metrics"
+)
+
+var (
+	metricPublicConns = metrics.NewCounterVec("nrps_public_connections_total",
+		"Number of accepted public connections.", "protocol")
+	metricTunnelBytesIn = metrics.NewCounterVec("nrps_tunnel_received_bytes_total",
+		"Bytes received from public connections.", "tunnel", "protocol")
+	metricTunnelBytesOut = metrics.NewCounterVec("nrps_tunnel_sent_bytes_total",
+		"Bytes sent to public connections.", "tunnel", "protocol")
+	metricAuthFailures = metrics.NewCounterVec("nrps_auth_failures_total",
+		"Number of rejected auth requests.")
+	metricProxyTimeouts = metrics.NewCounterVec("nrps_proxy_timeouts_total",
+		"Number of timeouts waiting for a proxy connection.")
+	metricVhostNotFound = metrics.NewCounterVec("nrps_vhost_not_found_total",
+		"Number of public connections for unknown hosts.", "protocol")
+	metricHttpRequests = metrics.NewCounterVec("nrps_http_requests_total",
+		"Number of http requests proxied to tunnels.", "tunnel", "protocol")
+)
+
+func init() {
+	metrics.Register(
+		metrics.NewGaugeFunc("nrps_controls", "Number of connected clients.", func() float64 {
+			if gControlRegistry == nil {
+				return 0
+			}
+			return float64(len(gControlRegistry.All()))
+		}),
+		metrics.NewGaugeFunc("nrps_tunnels", "Number of registered tunnels.", func() float64 {
+			if gTunnelRegistry == nil {
+				return 0
+			}
+			return float64(len(gTunnelRegistry.All()))
+		}),
+		metrics.NewGaugeFunc("nrps_pooled_proxy_connections", "Number of idle proxy connections.", func() float64 {
+			if gControlRegistry == nil {
+				return 0
+			}
+			var n int
+			for _, ctl := range gControlRegistry.All() {
+				n += len(ctl.proxies)
+			}
+			return float64(n)
+		}),
+		metricPublicConns,
+		metricTunnelBytesIn,
+		metricTunnelBytesOut,
+		metricAuthFailures,
+		metricProxyTimeouts,
+		metricVhostNotFound,
+		metricHttpRequests,
+	)
+}
+
+// countedConn accounts the bytes of a public connection to its tunnel.
+type countedConn struct {
+	conn.IConn
+
+	url   string
+	proto string
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.IConn.Read(b)
+	metricTunnelBytesIn.Add(float64(n), c.url, c.proto)
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.IConn.Write(b)
+	metricTunnelBytesOut.Add(float64(n), c.url, c.proto)
+	return n, err
+}
+
+// countedProxyConn accounts the bytes of a proxy connection to its tunnel,
+// what is written to it was received from the public side.
+type countedProxyConn struct {
+	conn.IConn
+
+	url   string
+	proto string
+}
+
+func (c *countedProxyConn) Read(b []byte) (int, error) {
+	n, err := c.IConn.Read(b)
+	metricTunnelBytesOut.Add(float64(n), c.url, c.proto)
+	return n, err
+}
+
+func (c *countedProxyConn) Write(b []byte) (int, error) {
+	n, err := c.IConn.Write(b)
+	metricTunnelBytesIn.Add(float64(n), c.url, c.proto)
+	return n, err
+}
+
+func startMetricsServer(addr string) (*http.Server, net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+
+	return srv, l.Addr(), nil
+}
+
+func stopMetricsServer(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
+}
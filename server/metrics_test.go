@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tianhongw/grp/pkg/message"
+	"github.com/tianhongw/grp/pkg/metrics"
+)
+
+func TestTunnelMetricsOfGroup(t *testing.T) {
+	setTestGlobals(t, &settings{})
+
+	url := "http://metrics.nrp.me:80"
+	req := &message.TunnelRequest{Protocol: "http", Group: "web"}
+
+	c1, _ := newTestControl(t, "c1", "alice")
+	c2, _ := newTestControl(t, "c2", "alice")
+	t1 := addTestTunnel(t, c1, url, req)
+	t2 := addTestTunnel(t, c2, url, req)
+
+	collectors := map[string]metrics.Collector{
+		"nrps_tunnel_received_bytes_total": metricTunnelBytesIn,
+		"nrps_tunnel_sent_bytes_total":     metricTunnelBytesOut,
+		"nrps_http_requests_total":         metricHttpRequests,
+	}
+	metricTunnelBytesIn.Add(10, url, "http")
+	metricTunnelBytesOut.Add(20, url, "http")
+	metricHttpRequests.Inc(url, "http")
+
+	series := `{tunnel="` + url + `",protocol="http"}`
+	exported := func(c metrics.Collector) string {
+		var buf bytes.Buffer
+		if err := c.Write(&buf); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return buf.String()
+	}
+
+	// the series are shared by the group
+	c1.killTunnel(t1)
+	for name, c := range collectors {
+		if out := exported(c); !strings.Contains(out, name+series) {
+			t.Errorf("%s is gone with one member of the group:\n%s", name, out)
+		}
+	}
+
+	// and released with its last member
+	c2.killTunnel(t2)
+	for name, c := range collectors {
+		if out := exported(c); strings.Contains(out, series) {
+			t.Errorf("%s of a released url:\n%s", name, out)
+		}
+	}
+}
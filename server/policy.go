@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+const anyUser = "*"
+
+type portRange struct {
+	from, to int
+}
+
+type policy struct {
+	subDomains []string
+	hostNames  []string
+	ports      []portRange
+	protocols  map[string]bool
+	maxTunnels int
+}
+
+type policySet struct {
+	policies map[string]*policy
+}
+
+func newPolicySet(opts []*conf.PolicyOption) (*policySet, error) {
+	ps := &policySet{
+		policies: make(map[string]*policy),
+	}
+
+	for _, opt := range opts {
+		p, err := newPolicy(opt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(opt.Users) == 0 {
+			return nil, fmt.Errorf("policy without users")
+		}
+
+		for _, user := range opt.Users {
+			if _, ok := ps.policies[user]; ok {
+				return nil, fmt.Errorf("duplicated policy for user: %s", user)
+			}
+			ps.policies[user] = p
+		}
+	}
+
+	return ps, nil
+}
+
+func newPolicy(opt *conf.PolicyOption) (*policy, error) {
+	p := &policy{
+		maxTunnels: opt.MaxTunnels,
+	}
+
+	for _, pattern := range opt.SubDomains {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad sub domain pattern: %s", pattern)
+		}
+		p.subDomains = append(p.subDomains, pattern)
+	}
+
+	for _, pattern := range opt.HostNames {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad host name pattern: %s", pattern)
+		}
+		p.hostNames = append(p.hostNames, pattern)
+	}
+
+	for _, ports := range opt.Ports {
+		r, err := parsePortRange(ports)
+		if err != nil {
+			return nil, err
+		}
+		p.ports = append(p.ports, r)
+	}
+
+	if len(opt.Protocols) > 0 {
+		p.protocols = make(map[string]bool)
+		for _, proto := range opt.Protocols {
+			p.protocols[strings.ToLower(proto)] = true
+		}
+	}
+
+	return p, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+
+	from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port range: %s", s)
+	}
+
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return portRange{}, fmt.Errorf("bad port range: %s", s)
+		}
+	}
+
+	if from <= 0 || to > 65535 || from > to {
+		return portRange{}, fmt.Errorf("bad port range: %s", s)
+	}
+
+	return portRange{from: from, to: to}, nil
+}
+
+// get returns the policy of the user, nil means the user is not restricted.
+func (ps *policySet) get(user string) *policy {
+	if p, ok := ps.policies[user]; ok {
+		return p
+	}
+
+	return ps.policies[anyUser]
+}
+
+// check returns an error describing why the tunnel request is denied,
+// tunnels is the number of tunnels the user already has. A host name below
+// domain is a sub domain in disguise, it must pass the sub domain rules too,
+// and a policy with sub domain but no host name rules denies the others.
+func (p *policy) check(req *message.TunnelRequest, tunnels int, domain string) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.maxTunnels > 0 && tunnels >= p.maxTunnels {
+		return fmt.Errorf("tunnel limit of %d reached", p.maxTunnels)
+	}
+
+	proto := strings.ToLower(req.Protocol)
+	if p.protocols != nil && !p.protocols[proto] {
+		return fmt.Errorf("protocol %s is not allowed", proto)
+	}
+
+	switch proto {
+	case "tcp", "udp":
+		if len(p.ports) == 0 {
+			return nil
+		}
+		if req.RemotePort == 0 {
+			return fmt.Errorf("remote port is required")
+		}
+		for _, r := range p.ports {
+			if req.RemotePort >= r.from && req.RemotePort <= r.to {
+				return nil
+			}
+		}
+		return fmt.Errorf("remote port %d is not allowed", req.RemotePort)
+	default:
+		hostName := strings.ToLower(strings.TrimSpace(req.HostName))
+		if hostName != "" && len(p.hostNames) > 0 && !matchAny(p.hostNames, hostName) {
+			return fmt.Errorf("host name %s is not allowed", hostName)
+		}
+
+		sub, inDomain := subDomainOf(hostName, domain)
+		if inDomain && len(p.subDomains) > 0 && !matchAny(p.subDomains, sub) {
+			return fmt.Errorf("host name %s is not allowed", hostName)
+		}
+
+		// a policy limited to sub domains allows no external host names
+		if hostName != "" && !inDomain && len(p.hostNames) == 0 && len(p.subDomains) > 0 {
+			return fmt.Errorf("host name %s is not allowed", hostName)
+		}
+
+		subDomain := strings.ToLower(strings.TrimSpace(req.SubDomain))
+		if hostName == "" && subDomain != "" && len(p.subDomains) > 0 &&
+			!matchAny(p.subDomains, subDomain) {
+			return fmt.Errorf("sub domain %s is not allowed", subDomain)
+		}
+	}
+
+	return nil
+}
+
+// subDomainOf returns the labels of hostName, port ignored, below domain,
+// empty for the domain itself, and false if hostName isn't in domain.
+func subDomainOf(hostName, domain string) (string, bool) {
+	host := hostName
+	if h, _, err := net.SplitHostPort(hostName); err == nil {
+		host = h
+	}
+
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return "", false
+	}
+
+	if host == domain {
+		return "", true
+	}
+
+	if strings.HasSuffix(host, "."+domain) {
+		return strings.TrimSuffix(host, "."+domain), true
+	}
+
+	return "", false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+func newTestPolicy(t *testing.T, opt *conf.PolicyOption) *policy {
+	t.Helper()
+
+	p, err := newPolicy(opt)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+
+	return p
+}
+
+func TestPolicyCheck(t *testing.T) {
+	subDomains := newTestPolicy(t, &conf.PolicyOption{SubDomains: []string{"dev-*"}})
+	hostNames := newTestPolicy(t, &conf.PolicyOption{HostNames: []string{"*.team.com"}})
+	both := newTestPolicy(t, &conf.PolicyOption{
+		SubDomains: []string{"dev-*"},
+		HostNames:  []string{"*.team.com"},
+	})
+	ports := newTestPolicy(t, &conf.PolicyOption{
+		Ports:      []string{"8080", "10000-10100"},
+		Protocols:  []string{"TCP", "http"},
+		MaxTunnels: 2,
+	})
+
+	tests := []struct {
+		name    string
+		p       *policy
+		req     message.TunnelRequest
+		tunnels int
+		ok      bool
+	}{
+		{"no policy", nil, message.TunnelRequest{Protocol: "http", HostName: "a.com"}, 100, true},
+
+		{"sub domain", subDomains, message.TunnelRequest{Protocol: "http", SubDomain: "dev-a"}, 0, true},
+		{"sub domain denied", subDomains, message.TunnelRequest{Protocol: "http", SubDomain: "prod"}, 0, false},
+		{"sub domain case", subDomains, message.TunnelRequest{Protocol: "http", SubDomain: " DEV-a "}, 0, true},
+		{"random sub domain", subDomains, message.TunnelRequest{Protocol: "http"}, 0, true},
+		// host names below the domain are sub domains
+		{"host in domain", subDomains, message.TunnelRequest{Protocol: "http", HostName: "dev-a.nrp.me"}, 0, true},
+		{"host in domain denied", subDomains, message.TunnelRequest{Protocol: "http", HostName: "prod.nrp.me"}, 0, false},
+		{"host in domain with port", subDomains, message.TunnelRequest{Protocol: "https", HostName: "prod.NRP.me:443"}, 0, false},
+		// and external ones are denied without host name rules
+		{"external host", subDomains, message.TunnelRequest{Protocol: "http", HostName: "dev-a.com"}, 0, false},
+		{"external host with a sub domain", subDomains, message.TunnelRequest{Protocol: "http", HostName: "x.com", SubDomain: "dev-a"}, 0, false},
+
+		{"host name", hostNames, message.TunnelRequest{Protocol: "http", HostName: "a.team.com"}, 0, true},
+		{"host name denied", hostNames, message.TunnelRequest{Protocol: "http", HostName: "a.other.com"}, 0, false},
+		{"host name rules allow any sub domain", hostNames, message.TunnelRequest{Protocol: "http", SubDomain: "prod"}, 0, true},
+
+		{"both host name", both, message.TunnelRequest{Protocol: "http", HostName: "a.team.com"}, 0, true},
+		{"both sub domain", both, message.TunnelRequest{Protocol: "http", SubDomain: "dev-a"}, 0, true},
+		{"both external denied", both, message.TunnelRequest{Protocol: "http", HostName: "a.other.com"}, 0, false},
+		{"both in domain denied", both, message.TunnelRequest{Protocol: "http", HostName: "prod.nrp.me"}, 0, false},
+
+		{"port", ports, message.TunnelRequest{Protocol: "tcp", RemotePort: 8080}, 0, true},
+		{"port range", ports, message.TunnelRequest{Protocol: "tcp", RemotePort: 10100}, 1, true},
+		{"port denied", ports, message.TunnelRequest{Protocol: "tcp", RemotePort: 10101}, 0, false},
+		{"random port denied", ports, message.TunnelRequest{Protocol: "tcp"}, 0, false},
+		{"protocol denied", ports, message.TunnelRequest{Protocol: "udp", RemotePort: 8080}, 0, false},
+		{"tunnel limit", ports, message.TunnelRequest{Protocol: "tcp", RemotePort: 8080}, 2, false},
+		{"no port rules for http", ports, message.TunnelRequest{Protocol: "HTTP", HostName: "a.com"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.p.check(&tt.req, tt.tunnels, "nrp.me")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok: %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPolicySet(t *testing.T) {
+	ps, err := newPolicySet([]*conf.PolicyOption{
+		{Users: []string{"alice", "bob"}, MaxTunnels: 1},
+		{Users: []string{anyUser}, MaxTunnels: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, want := range map[string]int{"alice": 1, "bob": 1, "carol": 2, "": 2} {
+		if p := ps.get(user); p == nil || p.maxTunnels != want {
+			t.Errorf("policy of %q: %+v, want max tunnels %d", user, p, want)
+		}
+	}
+
+	bad := [][]*conf.PolicyOption{
+		{{}},
+		{{Users: []string{"alice"}}, {Users: []string{"alice"}}},
+		{{Users: []string{"alice"}, SubDomains: []string{"["}}},
+		{{Users: []string{"alice"}, Ports: []string{"100-10"}}},
+		{{Users: []string{"alice"}, Ports: []string{"65536"}}},
+		{{Users: []string{"alice"}, Ports: []string{"x"}}},
+	}
+	for _, opts := range bad {
+		if _, err := newPolicySet(opts); err == nil {
+			t.Errorf("policies %+v: no error", opts[len(opts)-1])
+		}
+	}
+
+	if ps, _ := newPolicySet(nil); ps.get("alice") != nil {
+		t.Error("no policies restrict users")
+	}
+}
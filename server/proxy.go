@@ -5,11 +5,20 @@ import (
 	"github.com/tianhongw/grp/pkg/message"
 )
 
-func newProxy(conn conn.IConn, req *message.ProxyReg) {
+func newProxy(conn conn.IConn, req *message.ProxyReg, identity string) {
 	conn.Infof("new proxy for client: %s", req.ClientId)
+
+	if err := gControlRegistry.checkIdentity(req.ClientId, identity); err != nil {
+		conn.Errorf("reject proxy: %v", err)
+		conn.Close()
+		return
+	}
+
 	ctl := gControlRegistry.Get(req.ClientId)
 	if ctl == nil {
-		panic("no control find for client: " + req.ClientId)
+		conn.Errorf("no control find for client: %s", req.ClientId)
+		conn.Close()
+		return
 	}
 
 	ctl.registerProxy(conn)
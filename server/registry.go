@@ -2,6 +2,8 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 
 	"github.com/tianhongw/grp/conf"
@@ -10,14 +12,14 @@ import (
 
 type TunnelRegistry struct {
 	mu      sync.Mutex
-	tunnels map[string]*Tunnel
+	tunnels map[string]*tunnelGroup
 
 	lg log.Logger
 }
 
 func newTunnelRegistry(cfg *conf.Config) *TunnelRegistry {
 	tr := &TunnelRegistry{
-		tunnels: map[string]*Tunnel{},
+		tunnels: map[string]*tunnelGroup{},
 	}
 
 	lg, err := log.NewLogger(cfg.Log.Type,
@@ -32,36 +34,227 @@ func newTunnelRegistry(cfg *conf.Config) *TunnelRegistry {
 	return tr
 }
 
-func (tr *TunnelRegistry) Get(url string) *Tunnel {
+// Members returns the tunnels registered for url, more than one if they
+// joined a group.
+func (tr *TunnelRegistry) Members(url string) []*Tunnel {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
-	return tr.tunnels[url]
+	g, ok := tr.tunnels[url]
+	if !ok {
+		return nil
+	}
+
+	members := make([]*Tunnel, len(g.members))
+	copy(members, g.members)
+
+	return members
+}
+
+// Lookup returns the tunnel serving path on host. An exact host wins over
+// wildcards and the longest wildcard over shorter ones, then the longest
+// path prefix registered for that host wins.
+func (tr *TunnelRegistry) Lookup(proto, host, path string) *Tunnel {
+	url := fmt.Sprintf("%s://%s", proto, host)
+	prefixes := pathPrefixes(path)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	for _, hostURL := range append([]string{url}, wildcardsOf(url)...) {
+		for _, prefix := range prefixes {
+			if g, ok := tr.tunnels[hostURL+prefix]; ok {
+				return g.pick()
+			}
+		}
+	}
+
+	return nil
 }
 
+// Register claims url for t. Wildcard urls (*.foo.nrp.me) claim every host
+// below them, so a url below a wildcard of another owner is refused, and so
+// is a wildcard covering urls of another owner. A host and all the paths on
+// it belong to one owner, whose tunnels may claim different paths on it or
+// share a url by joining the same group.
 func (tr *TunnelRegistry) Register(t *Tunnel, url string) error {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
 
-	if tr.tunnels[url] != nil {
-		return fmt.Errorf("tunnel: %s is already registered", url)
+	if g, ok := tr.tunnels[url]; ok {
+		if err := g.canJoin(t); err != nil {
+			return err
+		}
+		g.members = append(g.members, t)
+		tr.lg.Infof("tunnel: %s joined group: %s with %d members", url, g.name, len(g.members))
+		return nil
 	}
 
-	tr.tunnels[url] = t
+	for other, og := range tr.tunnels {
+		if sameOwner(t, og.owner()) {
+			continue
+		}
+
+		if matchWildcard(other, url) {
+			return fmt.Errorf("tunnel: %s is covered by: %s of another client", url, other)
+		}
+
+		if matchWildcard(url, other) {
+			return fmt.Errorf("tunnel: %s covers: %s of another client", url, other)
+		}
+
+		if hostURL(url) == hostURL(other) {
+			return fmt.Errorf("tunnel: %s is on the host of: %s of another client", url, other)
+		}
+	}
+
+	tr.tunnels[url] = newTunnelGroup(t)
 
 	return nil
 }
 
+// Unregister removes t from url and reports whether it was the last tunnel
+// serving url.
+func (tr *TunnelRegistry) Unregister(t *Tunnel, url string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	g, ok := tr.tunnels[url]
+	if !ok {
+		return false
+	}
+
+	g.remove(t)
+	if len(g.members) == 0 {
+		delete(tr.tunnels, url)
+		return true
+	}
+
+	return false
+}
+
+func (tr *TunnelRegistry) All() []*Tunnel {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tunnels := make([]*Tunnel, 0, len(tr.tunnels))
+	for _, g := range tr.tunnels {
+		tunnels = append(tunnels, g.members...)
+	}
+
+	return tunnels
+}
+
+// sameOwner reports whether both tunnels belong to the same client or user.
+func sameOwner(a, b *Tunnel) bool {
+	ca, cb := a.getCtl(), b.getCtl()
+
+	return ca == cb || (ca.user != "" && ca.user == cb.user)
+}
+
+// splitURL splits proto://host:port/path, port and path may be empty.
+func splitURL(url string) (proto, host, port, path string) {
+	rest := url
+	if i := strings.Index(rest, "://"); i >= 0 {
+		proto, rest = rest[:i], rest[i+3:]
+	}
+
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, path = rest[:i], rest[i:]
+	}
+
+	host = rest
+	if h, p, err := net.SplitHostPort(rest); err == nil {
+		host, port = h, p
+	}
+
+	return proto, host, port, path
+}
+
+// hostURL returns url without its path.
+func hostURL(url string) string {
+	proto, host, port, _ := splitURL(url)
+
+	return joinURL(proto, host, port)
+}
+
+func joinURL(proto, host, port string) string {
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return fmt.Sprintf("%s://%s", proto, host)
+}
+
+// wildcardsOf returns the wildcard host urls which could match the host of
+// url, the most specific first: a.b.nrp.me gives *.b.nrp.me, *.nrp.me and
+// *.me.
+func wildcardsOf(url string) []string {
+	proto, host, port, _ := splitURL(url)
+
+	var patterns []string
+	for {
+		i := strings.Index(host, ".")
+		if i < 0 {
+			return patterns
+		}
+		host = host[i+1:]
+		patterns = append(patterns, joinURL(proto, "*."+host, port))
+	}
+}
+
+// matchWildcard reports whether the host of pattern is a wildcard matching
+// the host of url, whatever their paths.
+func matchWildcard(pattern, url string) bool {
+	proto, host, port, _ := splitURL(pattern)
+	if !strings.HasPrefix(host, "*.") {
+		return false
+	}
+
+	hostPattern := joinURL(proto, host, port)
+	for _, p := range wildcardsOf(url) {
+		if p == hostPattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathPrefixes returns the prefixes of path at segment boundaries, the
+// longest first and the empty prefix last: /a/b gives /a/b, /a and "".
+func pathPrefixes(path string) []string {
+	var prefixes []string
+
+	path = strings.TrimRight(path, "/")
+	for path != "" {
+		prefixes = append(prefixes, path)
+
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+
+	return append(prefixes, "")
+}
+
 type ControlRegistry struct {
 	mu       sync.Mutex
 	controls map[string]*Control
 
+	// client ids claimed with a client certificate, by id, they stay bound
+	// to the certificate subject for the life of the server
+	identities map[string]string
+
 	lg log.Logger
 }
 
 func newControlRegistry(cfg *conf.Config) *ControlRegistry {
 	cr := &ControlRegistry{
-		controls: make(map[string]*Control),
+		controls:   make(map[string]*Control),
+		identities: make(map[string]string),
 	}
 
 	lg, err := log.NewLogger(cfg.Log.Type,
@@ -83,6 +276,36 @@ func (cr *ControlRegistry) Get(clientId string) *Control {
 	return cr.controls[clientId]
 }
 
+// checkIdentity fails if clientId may not be claimed by a peer presenting
+// identity, the subject of its client certificate or empty if it has none.
+// An id claimed with a certificate once is only given to that certificate.
+func (cr *ControlRegistry) checkIdentity(clientId, identity string) error {
+	if identity != "" && identity != clientId {
+		return fmt.Errorf("client: %s presented certificate of: %s", clientId, identity)
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if bound, ok := cr.identities[clientId]; ok && bound != identity {
+		return fmt.Errorf("client: %s is bound to a client certificate", clientId)
+	}
+
+	return nil
+}
+
+// bindIdentity binds clientId to the certificate subject identity.
+func (cr *ControlRegistry) bindIdentity(clientId, identity string) {
+	if identity == "" {
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.identities[clientId] = identity
+}
+
 func (cr *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
 	cr.mu.Lock()
 	oldCtl = cr.controls[clientId]
@@ -114,13 +337,21 @@ func (cr *ControlRegistry) Remove(clientId string) error {
 	return nil
 }
 
-func (cr *ControlRegistry) exit() {
+func (cr *ControlRegistry) All() []*Control {
 	cr.mu.Lock()
 	defer cr.mu.Unlock()
 
+	controls := make([]*Control, 0, len(cr.controls))
 	for _, ctl := range cr.controls {
-		ctl.exit()
+		controls = append(controls, ctl)
 	}
 
-	return
+	return controls
+}
+
+func (cr *ControlRegistry) exit() {
+	// exiting controls remove themselves, so don't hold the lock
+	for _, ctl := range cr.All() {
+		ctl.kill()
+	}
 }
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+func newTestRegistry(t *testing.T) *TunnelRegistry {
+	t.Helper()
+
+	return newTunnelRegistry(&conf.Config{Log: &conf.LogOption{Type: "std", Level: "error"}})
+}
+
+func newTestTunnel(user, url string) *Tunnel {
+	return &Tunnel{
+		req: &message.TunnelRequest{},
+		url: url,
+		ctl: &Control{clientId: user + "-client", user: user},
+	}
+}
+
+// register registers a tunnel of user for every url, by url.
+func register(t *testing.T, tr *TunnelRegistry, user string, urls ...string) map[string]*Tunnel {
+	t.Helper()
+
+	tunnels := make(map[string]*Tunnel)
+	for _, url := range urls {
+		tunnel := newTestTunnel(user, url)
+		if err := tr.Register(tunnel, url); err != nil {
+			t.Fatalf("register %s: %v", url, err)
+		}
+		tunnels[url] = tunnel
+	}
+
+	return tunnels
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	tr := newTestRegistry(t)
+
+	tunnels := register(t, tr, "alice",
+		"http://*.nrp.me:80",
+		"http://*.b.nrp.me:80",
+		"http://a.b.nrp.me:80",
+		"http://a.b.nrp.me:80/api",
+		"http://a.b.nrp.me:80/api/v2",
+		"http://c.nrp.me:80/only",
+		"https://a.b.nrp.me:443",
+	)
+
+	tests := []struct {
+		proto, host, path string
+		want              string
+	}{
+		// an exact host wins over wildcards
+		{"http", "a.b.nrp.me:80", "/", "http://a.b.nrp.me:80"},
+		// then the longest path prefix on it, at segment boundaries
+		{"http", "a.b.nrp.me:80", "/api", "http://a.b.nrp.me:80/api"},
+		{"http", "a.b.nrp.me:80", "/api/", "http://a.b.nrp.me:80/api"},
+		{"http", "a.b.nrp.me:80", "/api/v1/x", "http://a.b.nrp.me:80/api"},
+		{"http", "a.b.nrp.me:80", "/api/v2/x", "http://a.b.nrp.me:80/api/v2"},
+		{"http", "a.b.nrp.me:80", "/apix", "http://a.b.nrp.me:80"},
+		// the most specific wildcard wins over shorter ones
+		{"http", "x.b.nrp.me:80", "/", "http://*.b.nrp.me:80"},
+		{"http", "y.x.b.nrp.me:80", "/api", "http://*.b.nrp.me:80"},
+		{"http", "x.nrp.me:80", "/", "http://*.nrp.me:80"},
+		// a host whose paths don't match falls back to the wildcards
+		{"http", "c.nrp.me:80", "/only/x", "http://c.nrp.me:80/only"},
+		{"http", "c.nrp.me:80", "/other", "http://*.nrp.me:80"},
+		// protocols and ports are distinct
+		{"https", "a.b.nrp.me:443", "/api", "https://a.b.nrp.me:443"},
+		{"https", "x.b.nrp.me:443", "/", ""},
+		{"http", "a.b.nrp.me:8080", "/", ""},
+		// a wildcard doesn't match the bare domain
+		{"http", "nrp.me:80", "/", ""},
+	}
+
+	for _, tt := range tests {
+		got := tr.Lookup(tt.proto, tt.host, tt.path)
+
+		var gotURL string
+		if got != nil {
+			gotURL = got.url
+		}
+
+		if gotURL != tt.want {
+			t.Errorf("Lookup(%s, %s, %s) = %q, want %q", tt.proto, tt.host, tt.path, gotURL, tt.want)
+		}
+		if tt.want != "" && got != tunnels[tt.want] {
+			t.Errorf("Lookup(%s, %s, %s) returned another tunnel of %s", tt.proto, tt.host, tt.path, tt.want)
+		}
+	}
+}
+
+func TestRegisterWildcardOwners(t *testing.T) {
+	tr := newTestRegistry(t)
+
+	register(t, tr, "alice", "http://*.a.nrp.me:80", "http://x.b.nrp.me:80")
+
+	for _, url := range []string{
+		// below a wildcard of another owner
+		"http://x.a.nrp.me:80",
+		"http://y.x.a.nrp.me:80/api",
+		// covering a host of another owner
+		"http://*.b.nrp.me:80",
+		"http://*.nrp.me:80",
+		// taken
+		"http://x.b.nrp.me:80",
+		// a path on a host of another owner
+		"http://x.b.nrp.me:80/bob",
+	} {
+		if err := tr.Register(newTestTunnel("bob", url), url); err == nil {
+			t.Errorf("bob registered %s", url)
+		}
+	}
+
+	// the owner itself may, and so may anyone on other ports and protocols
+	register(t, tr, "alice", "http://x.a.nrp.me:80", "http://*.c.nrp.me:80", "http://x.b.nrp.me:80/alice")
+	register(t, tr, "bob", "http://x.a.nrp.me:8080", "https://x.a.nrp.me:80")
+}
+
+func TestRegisterPathOwners(t *testing.T) {
+	tr := newTestRegistry(t)
+
+	register(t, tr, "alice", "http://p.nrp.me:80/api")
+
+	for _, url := range []string{
+		// the whole host over paths of another owner
+		"http://p.nrp.me:80",
+		// other paths on it
+		"http://p.nrp.me:80/login",
+		"http://p.nrp.me:80/api/v2",
+	} {
+		if err := tr.Register(newTestTunnel("bob", url), url); err == nil {
+			t.Errorf("bob registered %s", url)
+		}
+
+		// anonymous clients are other owners to each other
+		anonymous := newTestTunnel("", url)
+		if err := tr.Register(anonymous, url); err == nil {
+			t.Errorf("an anonymous client registered %s", url)
+		}
+	}
+
+	// tunnels of the owner share the host by path
+	register(t, tr, "alice", "http://p.nrp.me:80", "http://p.nrp.me:80/login")
+
+	if got := tr.Lookup("http", "p.nrp.me:80", "/login/x"); got == nil || got.url != "http://p.nrp.me:80/login" {
+		t.Errorf("lookup of /login/x: %v", got)
+	}
+
+	// and once they're gone the host is free again
+	for _, url := range []string{"http://p.nrp.me:80", "http://p.nrp.me:80/api", "http://p.nrp.me:80/login"} {
+		for _, m := range tr.Members(url) {
+			tr.Unregister(m, url)
+		}
+	}
+	register(t, tr, "bob", "http://p.nrp.me:80/login")
+}
+
+func TestRegisterGroup(t *testing.T) {
+	tr := newTestRegistry(t)
+
+	url := "http://g.nrp.me:80"
+
+	first := newTestTunnel("alice", url)
+	first.req.Group = "web"
+	if err := tr.Register(first, url); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	second := newTestTunnel("alice", url)
+	second.req.Group = "web"
+	if err := tr.Register(second, url); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+
+	other := newTestTunnel("bob", url)
+	other.req.Group = "web"
+	if err := tr.Register(other, url); err == nil {
+		t.Error("another user joined the group")
+	}
+
+	if n := len(tr.Members(url)); n != 2 {
+		t.Fatalf("%d members, want 2", n)
+	}
+
+	tr.Unregister(first, url)
+	if got := tr.Lookup("http", "g.nrp.me:80", "/"); got != second {
+		t.Errorf("lookup after unregister: %v", got)
+	}
+
+	tr.Unregister(second, url)
+	if got := tr.Lookup("http", "g.nrp.me:80", "/"); got != nil {
+		t.Errorf("lookup of an empty group: %v", got)
+	}
+}
+
+func TestCheckWildcard(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://a.nrp.me:80", true},
+		{"http://*.a.nrp.me:80", true},
+		{"http://*.team.com:80/api", true},
+		// the whole domain, or above it
+		{"http://*.nrp.me:80", false},
+		{"https://*.NRP.me:443", false},
+		{"http://*.me:80", false},
+		// a top level domain
+		{"http://*.com:80", false},
+	}
+
+	for _, tt := range tests {
+		err := checkWildcard(tt.url, "NRP.me")
+		if (err == nil) != tt.ok {
+			t.Errorf("checkWildcard(%s) = %v, want ok: %v", tt.url, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ReservationSubDomain = "sub_domain"
+	ReservationHostName  = "host_name"
+	ReservationPort      = "port"
+
+	// random ports drawn again because they are reserved for another user
+	maxRandomPortTries = 10
+)
+
+var gReservations *reservationStore
+
+// reservation keeps a sub domain, host name or tcp/udp port for the tunnels
+// of one user, across client reconnects and server restarts.
+type reservation struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reservationStore holds the reservations in memory and writes them to a
+// json file on every change. A nil store has no reservations.
+type reservationStore struct {
+	mu sync.Mutex
+
+	file string
+
+	// by kind:name
+	reservations map[string]*reservation
+}
+
+func loadReservationStore(file string) (*reservationStore, error) {
+	rs := &reservationStore{
+		file:         file,
+		reservations: make(map[string]*reservation),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reservations []*reservation
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return nil, fmt.Errorf("parse reservations file: %s failed: %v", file, err)
+	}
+
+	for _, r := range reservations {
+		if err := normalizeReservation(r); err != nil {
+			return nil, err
+		}
+		rs.reservations[reservationKey(r.Kind, r.Name)] = r
+	}
+
+	return rs, nil
+}
+
+func reservationKey(kind, name string) string {
+	return kind + ":" + name
+}
+
+// normalizeReservation validates r and lowercases its name.
+func normalizeReservation(r *reservation) error {
+	r.Name = strings.ToLower(strings.TrimSpace(r.Name))
+	if r.Name == "" {
+		return fmt.Errorf("reservation without name")
+	}
+
+	if r.User == "" {
+		return fmt.Errorf("reservation of %s: %s without user", r.Kind, r.Name)
+	}
+
+	switch r.Kind {
+	case ReservationSubDomain, ReservationHostName:
+		if strings.Contains(r.Name, "*") {
+			return fmt.Errorf("invalid reserved name: %s", r.Name)
+		}
+	case ReservationPort:
+		port, err := strconv.Atoi(r.Name)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid reserved port: %s", r.Name)
+		}
+	default:
+		return fmt.Errorf("unknown reservation kind: %s", r.Kind)
+	}
+
+	return nil
+}
+
+// check fails if name is reserved for another user than user.
+func (rs *reservationStore) check(kind, name, user string) error {
+	if rs == nil {
+		return nil
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.reservations[reservationKey(kind, strings.ToLower(name))]
+	if !ok || r.User == user {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %s is reserved for another user", kind, name)
+}
+
+// checkHost fails if the host, or any host matched by it if it's a wildcard,
+// is reserved for another user than user, either as a host name or as a sub
+// domain of domain.
+func (rs *reservationStore) checkHost(host, domain, user string) error {
+	if rs == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, r := range rs.reservations {
+		if r.User == user {
+			continue
+		}
+
+		var reserved string
+		switch r.Kind {
+		case ReservationSubDomain:
+			reserved = r.Name + "." + domain
+		case ReservationHostName:
+			reserved = r.Name
+			if h, _, err := net.SplitHostPort(r.Name); err == nil {
+				reserved = h
+			}
+		default:
+			continue
+		}
+
+		if reserved == host ||
+			strings.HasPrefix(host, "*.") && strings.HasSuffix(reserved, host[1:]) {
+			return fmt.Errorf("%s: %s is reserved for another user", r.Kind, r.Name)
+		}
+	}
+
+	return nil
+}
+
+// reserve adds r, or hands an existing reservation of the same name over
+// to the user of r. Tunnels already serving the name are not affected.
+func (rs *reservationStore) reserve(r *reservation) error {
+	if err := normalizeReservation(r); err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	key := reservationKey(r.Kind, r.Name)
+
+	old, ok := rs.reservations[key]
+	rs.reservations[key] = r
+
+	if err := rs.save(); err != nil {
+		if ok {
+			rs.reservations[key] = old
+		} else {
+			delete(rs.reservations, key)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// revoke removes the reservation of name, it returns false if there is none.
+func (rs *reservationStore) revoke(kind, name string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	key := reservationKey(kind, strings.ToLower(strings.TrimSpace(name)))
+
+	old, ok := rs.reservations[key]
+	if !ok {
+		return false, nil
+	}
+
+	delete(rs.reservations, key)
+
+	if err := rs.save(); err != nil {
+		rs.reservations[key] = old
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (rs *reservationStore) list() []*reservation {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.sorted()
+}
+
+// sorted returns the reservations by kind and name, callers hold mu.
+func (rs *reservationStore) sorted() []*reservation {
+	keys := make([]string, 0, len(rs.reservations))
+	for key := range rs.reservations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	reservations := make([]*reservation, 0, len(keys))
+	for _, key := range keys {
+		reservations = append(reservations, rs.reservations[key])
+	}
+
+	return reservations
+}
+
+// save writes the reservations to a temp file renamed over the store, so a
+// crash never leaves a partial file behind. Callers hold mu.
+func (rs *reservationStore) save() error {
+	data, err := json.MarshalIndent(rs.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(rs.file), filepath.Base(rs.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), rs.file)
+}
@@ -0,0 +1,55 @@
+package server
+
+import "testing"
+
+func TestReservationCheckHost(t *testing.T) {
+	rs := &reservationStore{reservations: make(map[string]*reservation)}
+	for _, r := range []*reservation{
+		{Kind: ReservationSubDomain, Name: "foo", User: "alice"},
+		{Kind: ReservationHostName, Name: "app.example.com", User: "alice"},
+		{Kind: ReservationHostName, Name: "api.example.org:8080", User: "alice"},
+		{Kind: ReservationPort, Name: "10000", User: "alice"},
+	} {
+		if err := normalizeReservation(r); err != nil {
+			t.Fatal(err)
+		}
+		rs.reservations[reservationKey(r.Kind, r.Name)] = r
+	}
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		// a sub domain is reserved whichever field names it
+		{"foo.nrp.me", false},
+		{"FOO.nrp.me", false},
+		{"bar.nrp.me", true},
+		{"x.foo.nrp.me", true},
+		{"app.example.com", false},
+		{"api.example.org", false},
+		// wildcards covering reserved names
+		{"*.nrp.me", false},
+		{"*.example.com", false},
+		{"*.org", false},
+		{"*.foo.nrp.me", true},
+		{"*.other.com", true},
+		// ports are not host names
+		{"10000.nrp.me", true},
+	}
+
+	for _, tt := range tests {
+		if err := rs.checkHost(tt.host, "nrp.me", "bob"); (err == nil) != tt.ok {
+			t.Errorf("checkHost(%s) for bob = %v, want ok: %v", tt.host, err, tt.ok)
+		}
+
+		// the owner is never refused
+		if err := rs.checkHost(tt.host, "nrp.me", "alice"); err != nil {
+			t.Errorf("checkHost(%s) for alice = %v", tt.host, err)
+		}
+	}
+
+	var none *reservationStore
+	if err := none.checkHost("foo.nrp.me", "nrp.me", "bob"); err != nil {
+		t.Errorf("nil store: %v", err)
+	}
+}
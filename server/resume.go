@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+var gResumeStore = &resumeStore{sessions: make(map[string]*parkedSession)}
+
+// parkedSession holds the tunnels of a disconnected client until it
+// resumes them or the grace period ends.
+type parkedSession struct {
+	token string
+	user  string
+
+	tunnels []*Tunnel
+
+	timer *time.Timer
+}
+
+type resumeStore struct {
+	mu sync.Mutex
+
+	// by client id
+	sessions map[string]*parkedSession
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// park keeps the tunnels of the exiting control registered for grace, the
+// client reconnecting with the resume token of the control gets them back.
+// Tunnels still parked by an earlier control of the client are kept too,
+// the client only knows the newest token.
+func (rs *resumeStore) park(c *Control, tunnels []*Tunnel, grace time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	s, ok := rs.sessions[c.clientId]
+	if ok {
+		s.timer.Stop()
+	} else {
+		s = &parkedSession{}
+		rs.sessions[c.clientId] = s
+	}
+
+	for _, t := range tunnels {
+		atomic.StoreInt32(&t.parked, 1)
+	}
+
+	s.token = c.resumeToken
+	s.user = c.user
+	s.tunnels = append(s.tunnels, tunnels...)
+	s.timer = time.AfterFunc(grace, func() {
+		rs.expire(c.clientId, s)
+	})
+}
+
+// claim hands the parked tunnel matching req over to c, nil if there is
+// none or c didn't present the resume token.
+func (rs *resumeStore) claim(c *Control, req *message.TunnelRequest) *Tunnel {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	s, ok := rs.sessions[c.clientId]
+	if !ok || c.auth.ResumeToken == "" || s.user != c.user ||
+		subtle.ConstantTimeCompare([]byte(s.token), []byte(c.auth.ResumeToken)) != 1 {
+		return nil
+	}
+
+	for i, t := range s.tunnels {
+		if atomic.LoadInt32(&t.isExiting) == 1 || !sameRequest(t.req, req) {
+			continue
+		}
+
+		s.tunnels = append(s.tunnels[:i], s.tunnels[i+1:]...)
+		if len(s.tunnels) == 0 {
+			s.timer.Stop()
+			delete(rs.sessions, c.clientId)
+		}
+
+		t.setCtl(c)
+		atomic.StoreInt32(&t.parked, 0)
+
+		return t
+	}
+
+	return nil
+}
+
+// expire closes the tunnels nobody claimed within the grace period.
+func (rs *resumeStore) expire(clientId string, s *parkedSession) {
+	rs.mu.Lock()
+	if rs.sessions[clientId] != s {
+		rs.mu.Unlock()
+		return
+	}
+	delete(rs.sessions, clientId)
+	tunnels := s.tunnels
+	rs.mu.Unlock()
+
+	for _, t := range tunnels {
+		t.lg.Infof("resume grace period is over, release tunnel: %s", t.url)
+		t.exit()
+	}
+}
+
+// exit closes all parked tunnels.
+func (rs *resumeStore) exit() {
+	rs.mu.Lock()
+	sessions := rs.sessions
+	rs.sessions = make(map[string]*parkedSession)
+	rs.mu.Unlock()
+
+	for _, s := range sessions {
+		s.timer.Stop()
+		for _, t := range s.tunnels {
+			t.exit()
+		}
+	}
+}
+
+// sameRequest reports whether a and b ask for the same tunnel.
+func sameRequest(a, b *message.TunnelRequest) bool {
+	ra, rb := *a, *b
+	ra.RequestId, rb.RequestId = "", ""
+
+	return reflect.DeepEqual(ra, rb)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/log"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+// newTestResumer returns the control of a client reconnecting with token,
+// it isn't registered so the control it would replace stays parked.
+func newTestResumer(clientId, user, token string) *Control {
+	return &Control{
+		clientId: clientId,
+		user:     user,
+		auth:     &message.AuthRequest{ClientId: clientId, User: user, ResumeToken: token},
+		lg:       log.DummyLogger,
+		cfg:      testConfig,
+	}
+}
+
+func TestResumeClaim(t *testing.T) {
+	setTestGlobals(t, &settings{})
+
+	old, _ := newTestControl(t, "c1", "alice")
+	old.resumeToken = newResumeToken()
+	web := addTestTunnel(t, old, "http://web.nrp.me:80",
+		&message.TunnelRequest{RequestId: "1", Protocol: "http", SubDomain: "web"})
+	db := addTestTunnel(t, old, "tcp://nrp.me:5432",
+		&message.TunnelRequest{RequestId: "2", Protocol: "tcp", RemotePort: 5432})
+
+	gResumeStore.park(old, []*Tunnel{web, db}, time.Minute)
+	t.Cleanup(gResumeStore.exit)
+
+	for _, tunnel := range []*Tunnel{web, db} {
+		if !tunnel.isParked() {
+			t.Errorf("%s not parked", tunnel.url)
+		}
+		// parked tunnels keep their url
+		if members := gTunnelRegistry.Members(tunnel.url); len(members) != 1 || members[0] != tunnel {
+			t.Errorf("%s: members %v", tunnel.url, members)
+		}
+	}
+
+	// request ids differ between connections of a client
+	webReq := &message.TunnelRequest{RequestId: "7", Protocol: "http", SubDomain: "web"}
+
+	refused := []struct {
+		name string
+		c    *Control
+		req  *message.TunnelRequest
+	}{
+		{"wrong token", newTestResumer("c1", "alice", newResumeToken()), webReq},
+		{"no token", newTestResumer("c1", "alice", ""), webReq},
+		{"other user", newTestResumer("c1", "bob", old.resumeToken), webReq},
+		{"other client", newTestResumer("c2", "alice", old.resumeToken), webReq},
+		{"other request", newTestResumer("c1", "alice", old.resumeToken),
+			&message.TunnelRequest{Protocol: "http", SubDomain: "api"}},
+	}
+	for _, tt := range refused {
+		if tunnel := gResumeStore.claim(tt.c, tt.req); tunnel != nil {
+			t.Errorf("%s: claimed %s", tt.name, tunnel.url)
+		}
+	}
+
+	c := newTestResumer("c1", "alice", old.resumeToken)
+	if tunnel := gResumeStore.claim(c, webReq); tunnel != web {
+		t.Fatalf("claimed %v, want %s", tunnel, web.url)
+	}
+	if web.isParked() || web.getCtl() != c {
+		t.Error("the claimed tunnel was not handed over")
+	}
+
+	// a tunnel is claimed once
+	if tunnel := gResumeStore.claim(c, webReq); tunnel != nil {
+		t.Errorf("claimed %s twice", tunnel.url)
+	}
+
+	if tunnel := gResumeStore.claim(c, &message.TunnelRequest{Protocol: "tcp", RemotePort: 5432}); tunnel != db {
+		t.Fatalf("claimed %v, want %s", tunnel, db.url)
+	}
+
+	// the session ends with its last tunnel
+	gResumeStore.mu.Lock()
+	n := len(gResumeStore.sessions)
+	gResumeStore.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions after all tunnels were claimed", n)
+	}
+}
+
+func TestResumeExpiry(t *testing.T) {
+	setTestGlobals(t, &settings{})
+
+	c, _ := newTestControl(t, "c1", "alice")
+	c.resumeToken = newResumeToken()
+	tunnel := addTestTunnel(t, c, "http://web.nrp.me:80", &message.TunnelRequest{Protocol: "http", SubDomain: "web"})
+
+	gResumeStore.park(c, []*Tunnel{tunnel}, 100*time.Millisecond)
+	t.Cleanup(gResumeStore.exit)
+
+	select {
+	case <-tunnel.exitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the parked tunnel did not exit after the grace period")
+	}
+
+	if members := gTunnelRegistry.Members(tunnel.url); len(members) != 0 {
+		t.Errorf("%s still registered: %v", tunnel.url, members)
+	}
+
+	if got := gResumeStore.claim(newTestResumer("c1", "alice", c.resumeToken), tunnel.req); got != nil {
+		t.Errorf("claimed %s after the grace period", got.url)
+	}
+}
+
+func TestResumeParkAgain(t *testing.T) {
+	setTestGlobals(t, &settings{})
+
+	first, _ := newTestControl(t, "c1", "alice")
+	first.resumeToken = newResumeToken()
+	web := addTestTunnel(t, first, "http://web.nrp.me:80", &message.TunnelRequest{Protocol: "http", SubDomain: "web"})
+	gResumeStore.park(first, []*Tunnel{web}, 100*time.Millisecond)
+	t.Cleanup(gResumeStore.exit)
+
+	// the client reconnects without resuming, and disconnects again
+	second := newTestResumer("c1", "alice", "")
+	second.resumeToken = newResumeToken()
+	api := addTestTunnel(t, second, "http://api.nrp.me:80", &message.TunnelRequest{Protocol: "http", SubDomain: "api"})
+	gResumeStore.park(second, []*Tunnel{api}, time.Minute)
+
+	// the grace period of the first park no longer applies
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-web.exitChan:
+		t.Fatal("the tunnel parked first exited with the earlier grace period")
+	default:
+	}
+
+	// only the newest token is known to the client
+	if got := gResumeStore.claim(newTestResumer("c1", "alice", first.resumeToken), web.req); got != nil {
+		t.Errorf("claimed %s with an earlier token", got.url)
+	}
+
+	c := newTestResumer("c1", "alice", second.resumeToken)
+	for _, tunnel := range []*Tunnel{web, api} {
+		if got := gResumeStore.claim(c, tunnel.req); got != tunnel {
+			t.Errorf("claimed %v, want %s", got, tunnel.url)
+		}
+	}
+}
+
+func TestResumeStoreExit(t *testing.T) {
+	setTestGlobals(t, &settings{})
+
+	c, _ := newTestControl(t, "c1", "alice")
+	c.resumeToken = newResumeToken()
+	tunnel := addTestTunnel(t, c, "http://web.nrp.me:80", nil)
+	gResumeStore.park(c, []*Tunnel{tunnel}, time.Minute)
+
+	gResumeStore.exit()
+
+	select {
+	case <-tunnel.exitChan:
+	default:
+		t.Error("the parked tunnel did not exit with the store")
+	}
+}
+
+func TestSameRequest(t *testing.T) {
+	base := message.TunnelRequest{RequestId: "1", Protocol: "http", SubDomain: "web", PathPrefix: "/api"}
+
+	tests := []struct {
+		name string
+		edit func(r *message.TunnelRequest)
+		same bool
+	}{
+		{"same", func(r *message.TunnelRequest) {}, true},
+		{"other request id", func(r *message.TunnelRequest) { r.RequestId = "2" }, true},
+		{"other protocol", func(r *message.TunnelRequest) { r.Protocol = "https" }, false},
+		{"other sub domain", func(r *message.TunnelRequest) { r.SubDomain = "api" }, false},
+		{"other path", func(r *message.TunnelRequest) { r.PathPrefix = "/" }, false},
+		{"stripped prefix", func(r *message.TunnelRequest) { r.StripPrefix = true }, false},
+		{"other auth", func(r *message.TunnelRequest) { r.HttpAuth = "u:p" }, false},
+	}
+
+	for _, tt := range tests {
+		req := base
+		tt.edit(&req)
+		if got := sameRequest(&base, &req); got != tt.same {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
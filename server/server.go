@@ -2,6 +2,8 @@ package server
 
 import (
 	"crypto/tls"
+	"errors"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,6 +16,7 @@ import (
 
 var (
 	gListeners       map[string]*conn.Listener
+	gHttpServers     map[string]*http.Server
 	gTunnelRegistry  *TunnelRegistry
 	gControlRegistry *ControlRegistry
 )
@@ -34,6 +37,13 @@ type Server struct {
 	exitChan chan struct{}
 
 	isExiting int32
+
+	admin *adminServer
+
+	metrics *http.Server
+
+	// accepts the nrp clients
+	listener *conn.Listener
 }
 
 func NewServer(cfg *conf.Config) *Server {
@@ -55,26 +65,121 @@ func NewServer(cfg *conf.Config) *Server {
 }
 
 func (s *Server) Run() error {
+	settings, err := newSettings(s.cfg.Server)
+	if err != nil {
+		s.Errorf("init server settings failed: %v", err)
+		return err
+	}
+	gSettings.Store(settings)
+
 	gTunnelRegistry = newTunnelRegistry(s.cfg)
 
 	gControlRegistry = newControlRegistry(s.cfg)
 
+	if s.cfg.Server.ReservationsFile != "" {
+		if gReservations, err = loadReservationStore(s.cfg.Server.ReservationsFile); err != nil {
+			s.Errorf("load reservations failed: %v", err)
+			return err
+		}
+	}
+
 	gListeners = make(map[string]*conn.Listener)
+	gHttpServers = make(map[string]*http.Server)
 
 	if s.cfg.Server.HTTPAddr != "" {
-		httpListener, err := startHttpListener(s.cfg.Server.HTTPAddr, nil)
+		httpListener, httpServer, err := startHttpListener(s.cfg.Server.HTTPAddr, nil)
 		if err != nil {
 			return err
 		}
 		s.Infof("http listening on: %s", httpListener.Addr)
 		gListeners["http"] = httpListener
+		gHttpServers["http"] = httpServer
+	}
+
+	if s.cfg.Server.HTTPSAddr != "" {
+		tlsCfg, err := conn.LoadServerTLSConfig(s.cfg.Server.TLSCrt, s.cfg.Server.TLSKey)
+		if err != nil {
+			s.Errorf("load tls config failed: %v", err)
+			return err
+		}
+
+		httpsListener, httpsServer, err := startHttpListener(s.cfg.Server.HTTPSAddr, tlsCfg)
+		if err != nil {
+			return err
+		}
+		s.Infof("https listening on: %s", httpsListener.Addr)
+		gListeners["https"] = httpsListener
+		gHttpServers["https"] = httpsServer
+	}
+
+	if s.cfg.Server.TLSAddr != "" {
+		tlsListener, err := startTLSListener(s.cfg.Server.TLSAddr)
+		if err != nil {
+			return err
+		}
+		s.Infof("tls passthrough listening on: %s", tlsListener.Addr)
+		gListeners["tls"] = tlsListener
+	}
+
+	if s.cfg.Server.AdminAddr != "" {
+		admin, err := startAdminServer(s.cfg)
+		if err != nil {
+			s.Errorf("start admin api failed: %v", err)
+			return err
+		}
+		s.admin = admin
+	}
+
+	if s.cfg.Server.MetricsAddr != "" {
+		srv, addr, err := startMetricsServer(s.cfg.Server.MetricsAddr)
+		if err != nil {
+			s.Errorf("start metrics server failed: %v", err)
+			return err
+		}
+		s.Infof("metrics listening on: %s", addr)
+		s.metrics = srv
+	}
+
+	var tunnelTLSCfg *tls.Config
+	if s.cfg.Server.ClientTLS {
+		tlsCfg, err := conn.LoadServerTLSConfig(s.cfg.Server.TLSCrt, s.cfg.Server.TLSKey)
+		if err != nil {
+			s.Errorf("load tls config for client addr failed: %v", err)
+			return err
+		}
+
+		if s.cfg.Server.ClientCA != "" {
+			pool, err := conn.LoadCertPool(s.cfg.Server.ClientCA)
+			if err != nil {
+				s.Errorf("load client ca failed: %v", err)
+				return err
+			}
+			tlsCfg.ClientCAs = pool
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+			if s.cfg.Server.RequireClientCert {
+				tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		} else if s.cfg.Server.RequireClientCert {
+			return errors.New("require_client_cert is set without client_ca")
+		}
+
+		tunnelTLSCfg = tlsCfg
+	} else if s.cfg.Server.RequireClientCert {
+		return errors.New("require_client_cert is set without client_tls")
 	}
 
-	if err := s.tunnelListener(s.cfg.Server.ClientAddr, nil); err != nil {
+	listener, err := conn.Listen(s.cfg.Server.ClientAddr, "tunnel", tunnelTLSCfg)
+	if err != nil {
 		s.Errorf("start tunnel listener failed: %v", err)
 		return err
 	}
 
+	s.Infof("tunnel listening on %s", listener.Addr)
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.tunnelListener(listener)
+
 	return nil
 }
 
@@ -85,7 +190,26 @@ func (s *Server) Exit() error {
 
 	s.Info("exiting server")
 
-	gControlRegistry.exit()
+	// nothing to drain if the server failed to start
+	if s.listener != nil {
+		s.drain()
+	}
+
+	if s.admin != nil {
+		s.admin.exit()
+	}
+
+	if s.metrics != nil {
+		if err := stopMetricsServer(s.metrics); err != nil {
+			s.Errorf("stop metrics server failed: %v", err)
+		}
+	}
+
+	if gControlRegistry != nil {
+		gControlRegistry.exit()
+	}
+
+	gResumeStore.exit()
 
 	close(s.exitChan)
 
@@ -96,48 +220,83 @@ func (s *Server) Exit() error {
 	return nil
 }
 
-func (s *Server) tunnelListener(addr string, tlsConfig *tls.Config) error {
-	s.wg.Add(1)
-	defer s.wg.Done()
-
-	listener, err := conn.Listen(addr, "tunnel", tlsConfig)
+// Reload applies the log level, timeouts, authentication and policies of
+// cfg, the other options need a restart. Connected clients are kept, the
+// new policies apply to the tunnels they request from now on.
+func (s *Server) Reload(cfg *conf.Config) error {
+	settings, err := newSettings(cfg.Server)
 	if err != nil {
+		s.Errorf("reload server settings failed: %v", err)
 		return err
 	}
+	gSettings.Store(settings)
 
-	s.Infof("tunnel listening on %s", listener.Addr)
+	log.SetGlobalLevel(log.ParseLevel(cfg.Log.Level))
+
+	s.Info("config reloaded")
+
+	return nil
+}
+
+func (s *Server) tunnelListener(listener *conn.Listener) {
+	defer s.wg.Done()
 
 	for {
 		select {
 		case <-s.exitChan:
-			return nil
-		case conn := <-listener.Conns:
+			return
+		case conn, ok := <-listener.Conns:
+			if !ok {
+				return
+			}
 			go s.tunnelHandler(conn)
 		}
 	}
 }
 
-func (s *Server) tunnelHandler(conn conn.IConn) {
-	readTimeout := s.cfg.Server.ConnReadTimeoutSec
-	if readTimeout == 0 {
-		readTimeout = defaultConnReadTimeoutSec
-	}
+func (s *Server) tunnelHandler(c conn.IConn) {
+	settings := getSettings()
 
-	conn.SetReadDeadline(time.Now().Add(time.Duration(readTimeout) * time.Second))
-	rawMsg, err := message.ReadMsg(conn)
+	c.SetReadDeadline(time.Now().Add(settings.connReadTimeout))
+	rawMsg, err := message.ReadMsg(c)
 	if err != nil {
-		conn.Close()
+		c.Close()
 		return
 	}
 
-	conn.SetReadDeadline(time.Time{})
+	c.SetReadDeadline(time.Time{})
+
+	// the tls handshake is done once the first message is read
+	identity := conn.PeerIdentity(c)
 
 	switch m := rawMsg.(type) {
 	case *message.AuthRequest:
-		newControl(s.cfg, conn, m)
+		if err := checkProtocolVersion(m.Version, settings.minProtocolVersion); err != nil {
+			s.Errorf("reject client: %s from %s: %v", m.ClientId, c.RemoteAddr(), err)
+			message.WriteMsg(c, &message.AuthResponse{ErrorMsg: err.Error()})
+			c.Close()
+			return
+		}
+
+		user, err := settings.auth.Authenticate(m)
+		if err != nil {
+			s.Errorf("authenticate client: %s from %s failed: %v", m.ClientId, c.RemoteAddr(), err)
+			metricAuthFailures.Inc()
+			errMsg := errAuthFailed.Error()
+			if errors.Is(err, errAuthFailed) {
+				errMsg = err.Error()
+			}
+			message.WriteMsg(c, &message.AuthResponse{ErrorMsg: errMsg})
+			c.Close()
+			return
+		}
+		if _, err := newControl(s.cfg, c, m, identity, user); err != nil {
+			s.Errorf("new control for client: %s from %s failed: %v", m.ClientId, c.RemoteAddr(), err)
+			c.Close()
+		}
 	case *message.ProxyReg:
-		newProxy(conn, m)
+		newProxy(c, m, identity)
 	default:
-		conn.Close()
+		c.Close()
 	}
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/conf"
+	"github.com/tianhongw/grp/pkg/conn"
+	"github.com/tianhongw/grp/pkg/log"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+var testConfig = &conf.Config{Log: &conf.LogOption{Type: "std", Level: "error"}}
+
+// testConn is a conn.IConn over a net.Conn.
+type testConn struct {
+	net.Conn
+	log.DumbLogger
+}
+
+func (c *testConn) SetType(string) {}
+
+// setTestGlobals replaces the server globals for the test with empty ones,
+// s being the settings, and restores them after it.
+func setTestGlobals(t *testing.T, s *settings) {
+	t.Helper()
+
+	tunnels, controls, reservations, resume := gTunnelRegistry, gControlRegistry, gReservations, gResumeStore
+	publicConns := gPublicConns
+	prev, _ := gSettings.Load().(*settings)
+	t.Cleanup(func() {
+		gTunnelRegistry, gControlRegistry, gReservations, gResumeStore = tunnels, controls, reservations, resume
+		gPublicConns = publicConns
+		atomic.StoreInt32(&gDraining, 0)
+		if prev != nil {
+			gSettings.Store(prev)
+		}
+	})
+
+	if s.policies == nil {
+		s.policies = &policySet{policies: make(map[string]*policy)}
+	}
+	gSettings.Store(s)
+
+	gTunnelRegistry = newTunnelRegistry(testConfig)
+	gControlRegistry = newControlRegistry(testConfig)
+	gReservations = nil
+	gResumeStore = &resumeStore{sessions: make(map[string]*parkedSession)}
+	gPublicConns = &connSet{conns: make(map[conn.IConn]int)}
+}
+
+// initTestConfig sets the global config, which the connections accepted by
+// pkg/conn log with.
+func initTestConfig(t *testing.T) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "nrp.toml")
+	if err := ioutil.WriteFile(file, []byte("[log]\ntype = \"std\"\nlevel = \"error\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conf.Init(file, "toml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestControl returns a control registered in gControlRegistry, which
+// doesn't read or write messages, and the client end of its connection.
+func newTestControl(t *testing.T, clientId, user string) (*Control, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	c := &Control{
+		clientId: clientId,
+		user:     user,
+		auth:     &message.AuthRequest{ClientId: clientId, User: user},
+		conn:     &testConn{Conn: server},
+		codec:    message.CodecFromCapabilities(nil),
+		out:      make(chan message.Message),
+		in:       make(chan message.Message),
+		proxies:  make(chan conn.IConn, defaultProxyMaxSize),
+		tunnels:  make([]*Tunnel, 0),
+		exitChan: make(chan struct{}),
+		exited:   make(chan struct{}),
+		start:    time.Now(),
+		lastPing: time.Now(),
+		lg:       log.DummyLogger,
+		cfg:      testConfig,
+	}
+	gControlRegistry.Add(clientId, c)
+
+	return c, client
+}
+
+// addTestTunnel registers a tunnel of c on url.
+func addTestTunnel(t *testing.T, c *Control, url string, req *message.TunnelRequest) *Tunnel {
+	t.Helper()
+
+	if req == nil {
+		req = &message.TunnelRequest{Protocol: "http"}
+	}
+
+	tunnel := &Tunnel{
+		req:      req,
+		url:      url,
+		start:    time.Now(),
+		ctl:      c,
+		lg:       log.DummyLogger,
+		exitChan: make(chan struct{}),
+		cfg:      testConfig,
+	}
+	if err := gTunnelRegistry.Register(tunnel, url); err != nil {
+		t.Fatalf("register %s: %v", url, err)
+	}
+
+	c.mu.Lock()
+	c.tunnels = append(c.tunnels, tunnel)
+	c.mu.Unlock()
+
+	return tunnel
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tianhongw/grp/conf"
+)
+
+var gSettings atomic.Value
+
+// settings are the server options applied without restarting, they are
+// replaced as a whole when the config is reloaded.
+type settings struct {
+	auth Authenticator
+
+	policies *policySet
+
+	connReadTimeout  time.Duration
+	connWriteTimeout time.Duration
+
+	minProtocolVersion int
+
+	udpIdleTimeout time.Duration
+	udpMaxSessions int
+
+	drainTimeout time.Duration
+
+	// resumption is disabled if 0
+	resumeGrace time.Duration
+}
+
+func newSettings(opt *conf.ServerOption) (*settings, error) {
+	auth, err := newAuthenticator(opt.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := newPolicySet(opt.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		auth:               auth,
+		policies:           policies,
+		connReadTimeout:    secondsOr(opt.ConnReadTimeoutSec, defaultConnReadTimeoutSec),
+		connWriteTimeout:   secondsOr(opt.ConnWriteTimeoutSec, defaultConnWriteTimeoutSec),
+		minProtocolVersion: opt.MinProtocolVersion,
+		udpIdleTimeout:     secondsOr(opt.UDPIdleTimeoutSec, defaultUDPIdleTimeoutSec),
+		udpMaxSessions:     intOr(opt.UDPMaxSessions, defaultUDPMaxSessions),
+		drainTimeout:       secondsOr(opt.DrainTimeoutSec, defaultDrainTimeoutSec),
+		resumeGrace:        time.Duration(opt.ResumeGraceSec) * time.Second,
+	}, nil
+}
+
+func getSettings() *settings {
+	return gSettings.Load().(*settings)
+}
+
+func intOr(n, defaultN int) int {
+	if n <= 0 {
+		return defaultN
+	}
+
+	return n
+}
+
+func secondsOr(sec, defaultSec int) time.Duration {
+	if sec <= 0 {
+		sec = defaultSec
+	}
+
+	return time.Duration(sec) * time.Second
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/go-vhost"
+	"github.com/tianhongw/grp/pkg/conn"
+)
+
+// startTLSListener accepts tls connections without terminating them, they
+// are routed by the server name of the client hello and joined as is.
+func startTLSListener(addr string) (*conn.Listener, error) {
+	listener, err := conn.Listen(addr, "public", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	port := listener.Addr.(*net.TCPAddr).Port
+
+	go func() {
+		for conn := range listener.Conns {
+			go tlsHandle(conn, port)
+		}
+	}()
+
+	return listener, nil
+}
+
+func tlsHandle(c conn.IConn, port int) {
+	defer c.Close()
+
+	metricPublicConns.Inc("tls")
+
+	c.SetDeadline(time.Now().Add(defaultConnReadTimeoutSec * time.Second))
+
+	vhostConn, err := vhost.TLS(c)
+	if err != nil {
+		c.Errorf("bad tls client hello: %v", err)
+		return
+	}
+
+	host := strings.ToLower(vhostConn.Host())
+
+	vhostConn.Free()
+
+	c = conn.WrapConn(vhostConn, "public")
+
+	if host == "" {
+		c.Error("tls client hello without server name")
+		metricVhostNotFound.Inc("tls")
+		return
+	}
+
+	// sub domains are registered with the port, host names without
+	tunnel := gTunnelRegistry.Lookup("tls", fmt.Sprintf("%s:%d", host, port), "")
+	if tunnel == nil {
+		tunnel = gTunnelRegistry.Lookup("tls", host, "")
+	}
+	if tunnel == nil {
+		c.Errorf("can not find tunnel for server name: %s", host)
+		metricVhostNotFound.Inc("tls")
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+
+	tunnel.handlePublicConn(c)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+// serveTLSProxy plays the client of the tunnel on the proxy connection, it
+// reads the proxy start and terminates the tls connection passed through
+// with cert, answering what it reads with the url of the tunnel.
+func serveTLSProxy(t *testing.T, proxy *testConn, cert tls.Certificate) {
+	msg, err := message.ReadMsg(proxy)
+	if err != nil {
+		t.Errorf("read proxy start: %v", err)
+		return
+	}
+	start := msg.(*message.ProxyStart)
+
+	c := tls.Server(proxy, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer c.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Errorf("read through the tunnel: %v", err)
+		return
+	}
+	fmt.Fprintf(c, "%s %s", buf, start.URL)
+}
+
+func TestTLSRouting(t *testing.T) {
+	initTestConfig(t)
+	setTestGlobals(t, &settings{})
+
+	// the certificate of httptest is valid for example.com and its sub domains
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	defer certSrv.Close()
+	cert := certSrv.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(certSrv.Certificate())
+
+	l, err := startTLSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr.(*net.TCPAddr).Port
+
+	c, _ := newTestControl(t, "c1", "alice")
+	// sub domains are registered with the port, host names without
+	subDomain := fmt.Sprintf("tls://app.example.com:%d", port)
+	hostName := "tls://www.example.com"
+	addTestTunnel(t, c, subDomain, &message.TunnelRequest{Protocol: "tls"})
+	addTestTunnel(t, c, hostName, &message.TunnelRequest{Protocol: "tls"})
+	addTestTunnel(t, c, "tls://other.example.com:1", &message.TunnelRequest{Protocol: "tls"})
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"app.example.com", subDomain},
+		{"APP.example.com", subDomain},
+		{"www.example.com", hostName},
+	}
+
+	for _, tt := range tests {
+		proxy := offerProxy(t, c)
+		go serveTLSProxy(t, proxy, cert)
+
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr.String(),
+			&tls.Config{ServerName: tt.serverName, RootCAs: roots})
+		if err != nil {
+			t.Errorf("%s: %v", tt.serverName, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// the handshake went through to the client, untouched
+		io.WriteString(conn, "ping")
+		got, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Errorf("%s: %v", tt.serverName, err)
+		}
+		if want := "ping " + tt.want; string(got) != want {
+			t.Errorf("%s: got %q, want %q", tt.serverName, got, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestTLSRoutingRefused(t *testing.T) {
+	initTestConfig(t)
+	setTestGlobals(t, &settings{})
+
+	l, err := startTLSListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr.(*net.TCPAddr).Port
+
+	c, _ := newTestControl(t, "c1", "alice")
+	// tunnels of other ports and protocols
+	addTestTunnel(t, c, "tls://app.example.com:1", &message.TunnelRequest{Protocol: "tls"})
+	addTestTunnel(t, c, fmt.Sprintf("https://app.example.com:%d", port), nil)
+
+	dial := func(config *tls.Config) error {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr.String(), config)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		return err
+	}
+
+	for _, serverName := range []string{"app.example.com", "unknown.example.com"} {
+		if err := dial(&tls.Config{ServerName: serverName, InsecureSkipVerify: true}); err == nil {
+			t.Errorf("%s: connected", serverName)
+		}
+	}
+
+	// no server name in the client hello
+	if err := dial(&tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Error("no server name: connected")
+	}
+
+	// not tls at all
+	conn, err := net.Dial("tcp", l.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("plain http: read %d bytes, %v", n, err)
+	}
+
+	if len(c.proxies) != 0 {
+		t.Error("a refused connection took a proxy connection")
+	}
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,52 +28,131 @@ type Tunnel struct {
 
 	listener *net.TCPListener
 
+	// udp tunnels only
+	udp *udpRelay
+
+	// http tunnels only, normalized path prefix claimed on the host
+	pathPrefix string
+
+	// http tunnels only, nil if the requests are passed through untouched
+	headers *headerRules
+
+	// public connections being served
+	conns int64
+
 	lg log.Logger
 
+	// guards ctl, which changes when a client resumes the tunnel
+	mu  sync.Mutex
 	ctl *Control
 
 	isExiting int32
 	exitChan  chan struct{}
 
+	// set while the tunnel waits in the resume store for its client
+	parked int32
+
 	cfg *conf.Config
 }
 
+func (t *Tunnel) getCtl() *Control {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ctl
+}
+
+func (t *Tunnel) setCtl(ctl *Control) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ctl = ctl
+}
+
 func (t *Tunnel) exit() {
 	if !atomic.CompareAndSwapInt32(&t.isExiting, 0, 1) {
 		return
 	}
 
-	if t.listener != nil {
-		if err := t.listener.Close(); err != nil {
-			t.lg.Errorf("close tunnel listener failed: %v", err)
+	// the series of a url are shared by the members of its group
+	if gTunnelRegistry.Unregister(t, t.url) {
+		metricTunnelBytesIn.Delete(t.url, t.req.Protocol)
+		metricTunnelBytesOut.Delete(t.url, t.req.Protocol)
+		metricHttpRequests.Delete(t.url, t.req.Protocol)
+	}
+
+	t.stopAccepting()
+
+	if t.udp != nil {
+		if err := t.udp.close(); err != nil {
+			t.lg.Errorf("close udp tunnel failed: %v", err)
 		}
 	}
 
 	close(t.exitChan)
 }
 
+// stopAccepting closes the public listener of a tcp tunnel, the connections
+// already accepted are not affected.
+func (t *Tunnel) stopAccepting() {
+	if t.listener == nil {
+		return
+	}
+
+	if err := t.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		t.lg.Errorf("close tunnel listener failed: %v", err)
+	}
+}
+
+func (t *Tunnel) isParked() bool {
+	return atomic.LoadInt32(&t.parked) == 1
+}
+
+func (t *Tunnel) activeConns() int64 {
+	return atomic.LoadInt64(&t.conns)
+}
+
 func (t *Tunnel) handlePublicConn(pubConn conn.IConn) {
 	defer pubConn.Close()
 
-	proxyConn, err := t.ctl.getProxy()
+	atomic.AddInt64(&t.conns, 1)
+	defer atomic.AddInt64(&t.conns, -1)
+
+	gPublicConns.add(pubConn)
+	defer gPublicConns.remove(pubConn)
+
+	proxyConn, err := t.dialProxy(pubConn.RemoteAddr().String())
 	if err != nil {
-		t.lg.Errorf("get proxy failed: %v", err)
+		t.lg.Error(err)
 		return
 	}
 
+	conn.Join(&countedConn{IConn: pubConn, url: t.url, proto: t.req.Protocol}, proxyConn)
+}
+
+// dialProxy returns a proxy connection to the client of the tunnel, started
+// for the public connection from clientAddr.
+func (t *Tunnel) dialProxy(clientAddr string) (conn.IConn, error) {
+	ctl := t.getCtl()
+
+	proxyConn, err := ctl.getProxy()
+	if err != nil {
+		return nil, fmt.Errorf("get proxy failed: %v", err)
+	}
+
 	startProxyReq := &message.ProxyStart{
 		URL:        t.url,
-		ClientAddr: pubConn.RemoteAddr().String(),
+		ClientAddr: clientAddr,
 	}
 
-	if err := message.WriteMsg(proxyConn, startProxyReq); err != nil {
-		t.lg.Errorf("write start proxy request failed: %v", err)
-		return
+	if err := ctl.codec.WriteMsg(proxyConn, startProxyReq); err != nil {
+		proxyConn.Close()
+		return nil, fmt.Errorf("write start proxy request failed: %v", err)
 	}
 
 	proxyConn.SetDeadline(time.Time{})
 
-	conn.Join(pubConn, proxyConn)
+	return proxyConn, nil
 }
 
 func (t *Tunnel) listenTCP(listener *net.TCPListener) {
@@ -81,12 +164,16 @@ func (t *Tunnel) listenTCP(listener *net.TCPListener) {
 		}
 		tcpConn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			t.lg.Errorf("failed to accept new tcp connection: %v", err)
 			continue
 		}
 
 		conn := conn.WrapConn(tcpConn, "public")
 		t.lg.Infof("new connection from %s", conn.RemoteAddr())
+		metricPublicConns.Inc(t.req.Protocol)
 		go t.handlePublicConn(conn)
 	}
 }
@@ -103,12 +190,39 @@ func NewTunnel(req *message.TunnelRequest, ctl *Control, cfg *conf.Config) (*Tun
 
 	proto := tunnel.req.Protocol
 
+	if err := checkBalance(req.Balance); err != nil {
+		return nil, err
+	}
+
+	if req.Group != "" && proto != "http" && proto != "https" && proto != "tls" {
+		return nil, fmt.Errorf("groups are not supported for %s tunnels", proto)
+	}
+
+	tunnel.headers = newHeaderRules(req)
+	if tunnel.headers != nil {
+		if proto != "http" && proto != "https" {
+			return nil, fmt.Errorf("header rules are not supported for %s tunnels", proto)
+		}
+
+		if err := tunnel.headers.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.H2C && proto != "http" && proto != "https" {
+		return nil, fmt.Errorf("h2c is not supported for %s tunnels", proto)
+	}
+
 	switch proto {
 	case "tcp":
 		if err := tunnel.bindTcp(req.RemotePort); err != nil {
 			return nil, fmt.Errorf("bind tcp for port: %d failed: %v", req.RemotePort, err)
 		}
-	case "http", "https":
+	case "udp":
+		if err := tunnel.bindUdp(req.RemotePort); err != nil {
+			return nil, fmt.Errorf("bind udp for port: %d failed: %v", req.RemotePort, err)
+		}
+	case "http", "https", "tls":
 		l, ok := gListeners[proto]
 		if !ok {
 			return nil, fmt.Errorf("not listening for %s connections", proto)
@@ -129,15 +243,28 @@ func (t *Tunnel) bindTcp(port int) error {
 		return err
 	}
 
-	l, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return err
+	var l *net.TCPListener
+	for tries := 1; ; tries++ {
+		if l, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+			return err
+		}
+
+		bound := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		if err = gReservations.check(ReservationPort, bound, t.ctl.user); err == nil {
+			break
+		}
+
+		l.Close()
+		if port != 0 || tries == maxRandomPortTries {
+			return err
+		}
 	}
 	t.listener = l
 
 	t.url = fmt.Sprintf("tcp://%s:%d", t.cfg.Server.Domain, l.Addr().(*net.TCPAddr).Port)
 
 	if err := gTunnelRegistry.Register(t, t.url); err != nil {
+		l.Close()
 		return err
 	}
 
@@ -150,17 +277,76 @@ func registerVHost(t *Tunnel, domain, proto string, port int) error {
 	vhost := strings.ToLower(fmt.Sprintf("%s:%d", domain, port))
 
 	hostName := strings.ToLower(strings.TrimSpace(t.req.HostName))
-	if hostName != "" {
-		t.url = fmt.Sprintf("%s://%s", proto, hostName)
-		return gTunnelRegistry.Register(t, t.url)
+	subDomain := strings.ToLower(strings.TrimSpace(t.req.SubDomain))
+
+	prefix, err := normalizePathPrefix(t.req.PathPrefix)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && proto != "http" && proto != "https" {
+		return fmt.Errorf("path prefix is not supported for %s tunnels", proto)
 	}
+	t.pathPrefix = prefix
 
-	subDomain := strings.ToLower(strings.TrimSpace(t.req.SubDomain))
-	if subDomain != "" {
-		t.url = fmt.Sprintf("%s://%s.%s", proto, subDomain, vhost)
-		return gTunnelRegistry.Register(t, t.url)
+	// a wildcard is only allowed as the whole leftmost label
+	for _, name := range []string{hostName, subDomain} {
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return fmt.Errorf("invalid wildcard name: %s", name)
+		}
+	}
+
+	switch {
+	case hostName != "":
+		t.url = fmt.Sprintf("%s://%s%s", proto, hostName, prefix)
+	case subDomain != "":
+		t.url = fmt.Sprintf("%s://%s.%s%s", proto, subDomain, vhost, prefix)
+	default:
+		t.url = fmt.Sprintf("%s://%d.%s%s", proto, util.NewIntID(), vhost, prefix)
+	}
+
+	if err := checkWildcard(t.url, domain); err != nil {
+		return err
+	}
+
+	// whichever field names the host, and whatever hosts its wildcard covers
+	_, host, _, _ := splitURL(t.url)
+	if err := gReservations.checkHost(host, domain, t.ctl.user); err != nil {
+		return err
 	}
 
-	t.url = fmt.Sprintf("%s://%d.%s", proto, util.NewIntID(), vhost)
 	return gTunnelRegistry.Register(t, t.url)
 }
+
+// checkWildcard fails if the host of url is a wildcard covering the whole
+// domain of the server, or a top level domain, which would lock every other
+// client out of it.
+func checkWildcard(url, domain string) error {
+	_, host, _, _ := splitURL(url)
+	if !strings.HasPrefix(host, "*.") {
+		return nil
+	}
+
+	base := strings.ToLower(strings.TrimPrefix(host, "*."))
+	domain = strings.ToLower(domain)
+
+	if !strings.Contains(base, ".") || base == domain || strings.HasSuffix(domain, "."+base) {
+		return fmt.Errorf("wildcard: %s covers the whole domain", host)
+	}
+
+	return nil
+}
+
+// normalizePathPrefix returns the prefix as registered, /a/b without any
+// trailing slash, or empty for the whole host.
+func normalizePathPrefix(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#*") {
+		return "", fmt.Errorf("invalid path prefix: %s", prefix)
+	}
+
+	return strings.TrimRight(path.Clean(prefix), "/"), nil
+}
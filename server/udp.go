@@ -0,0 +1,268 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+const (
+	defaultUDPIdleTimeoutSec = 60
+	defaultUDPMaxSessions    = 256
+
+	// datagrams queued while the proxy of a session is set up
+	udpSessionQueueSize = 64
+)
+
+// udpRelay dispatches the datagrams received on the public port of a udp
+// tunnel to one session per remote address.
+type udpRelay struct {
+	t    *Tunnel
+	conn *net.UDPConn
+
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	// set once a new remote is refused, so that it's only logged once
+	// until a session ends
+	full bool
+}
+
+// udpSession relays the datagrams of one remote address over its own proxy
+// connection, framed by conn.WriteDatagram.
+type udpSession struct {
+	relay  *udpRelay
+	remote *net.UDPAddr
+
+	in chan []byte
+
+	// unix nano of the last datagram in either direction
+	lastActive int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (t *Tunnel) bindUdp(port int) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	var l *net.UDPConn
+	for tries := 1; ; tries++ {
+		if l, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return err
+		}
+
+		bound := strconv.Itoa(l.LocalAddr().(*net.UDPAddr).Port)
+		if err = gReservations.check(ReservationPort, bound, t.ctl.user); err == nil {
+			break
+		}
+
+		l.Close()
+		if port != 0 || tries == maxRandomPortTries {
+			return err
+		}
+	}
+
+	t.url = fmt.Sprintf("udp://%s:%d", t.cfg.Server.Domain, l.LocalAddr().(*net.UDPAddr).Port)
+
+	if err := gTunnelRegistry.Register(t, t.url); err != nil {
+		l.Close()
+		return err
+	}
+
+	t.udp = &udpRelay{
+		t:           t,
+		conn:        l,
+		idleTimeout: getSettings().udpIdleTimeout,
+		sessions:    make(map[string]*udpSession),
+	}
+
+	go t.udp.listen()
+
+	return nil
+}
+
+func (r *udpRelay) listen() {
+	buf := make([]byte, conn.MaxDatagramSize)
+
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.t.lg.Errorf("read udp datagram failed: %v", err)
+			continue
+		}
+
+		if s := r.getSession(addr); s != nil {
+			s.push(append([]byte(nil), buf[:n]...))
+		}
+	}
+}
+
+// getSession returns the session of addr, a new one is started unless the
+// server is draining or the tunnel has as many sessions as allowed.
+func (r *udpRelay) getSession(addr *net.UDPAddr) *udpSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := addr.String()
+	if s, ok := r.sessions[key]; ok {
+		return s
+	}
+
+	// a draining server only serves the sessions it already has
+	if isDraining() {
+		return nil
+	}
+
+	// every session holds a proxy connection of the client
+	if max := getSettings().udpMaxSessions; len(r.sessions) >= max {
+		if !r.full {
+			r.t.lg.Warningf("udp sessions limit of %d reached, dropping datagrams from new remotes", max)
+			r.full = true
+		}
+		return nil
+	}
+
+	s := &udpSession{
+		relay:      r,
+		remote:     addr,
+		in:         make(chan []byte, udpSessionQueueSize),
+		lastActive: time.Now().UnixNano(),
+		closed:     make(chan struct{}),
+	}
+	r.sessions[key] = s
+
+	r.t.lg.Infof("new udp session from %s", addr)
+	metricPublicConns.Inc("udp")
+
+	go s.run()
+
+	return s
+}
+
+func (r *udpRelay) removeSession(s *udpSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := s.remote.String()
+	if r.sessions[key] == s {
+		delete(r.sessions, key)
+		r.full = false
+	}
+}
+
+func (r *udpRelay) close() error {
+	return r.conn.Close()
+}
+
+// push queues a datagram from the remote, it's dropped if the queue is full
+// just like the network would do.
+func (s *udpSession) push(b []byte) {
+	select {
+	case s.in <- b:
+		s.touch()
+	default:
+		s.relay.t.lg.Warningf("udp session of %s is congested, dropping datagram", s.remote)
+	}
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (s *udpSession) run() {
+	t := s.relay.t
+
+	defer s.relay.removeSession(s)
+	defer s.close()
+
+	ctl := t.getCtl()
+
+	proxyConn, err := ctl.getProxy()
+	if err != nil {
+		t.lg.Errorf("get proxy for udp session of %s failed: %v", s.remote, err)
+		return
+	}
+	defer proxyConn.Close()
+
+	if err := ctl.codec.WriteMsg(proxyConn, &message.ProxyStart{
+		URL:        t.url,
+		ClientAddr: s.remote.String(),
+	}); err != nil {
+		t.lg.Errorf("write start proxy request failed: %v", err)
+		return
+	}
+
+	proxyConn.SetDeadline(time.Time{})
+
+	go s.replies(proxyConn)
+
+	check := time.NewTicker(s.relay.idleTimeout / 2)
+	defer check.Stop()
+
+	for {
+		select {
+		case b := <-s.in:
+			if err := conn.WriteDatagram(proxyConn, b); err != nil {
+				t.lg.Errorf("relay datagram of %s failed: %v", s.remote, err)
+				return
+			}
+			metricTunnelBytesIn.Add(float64(len(b)), t.url, t.req.Protocol)
+		case <-check.C:
+			if s.idle() > s.relay.idleTimeout {
+				t.lg.Infof("udp session of %s is idle, closing", s.remote)
+				return
+			}
+		case <-s.closed:
+			return
+		case <-t.exitChan:
+			return
+		}
+	}
+}
+
+// replies sends the datagrams of the client back to the remote.
+func (s *udpSession) replies(proxyConn conn.IConn) {
+	t := s.relay.t
+
+	defer s.close()
+
+	buf := make([]byte, conn.MaxDatagramSize)
+	for {
+		n, err := conn.ReadDatagram(proxyConn, buf)
+		if err != nil {
+			return
+		}
+		s.touch()
+
+		if _, err := s.relay.conn.WriteToUDP(buf[:n], s.remote); err != nil {
+			t.lg.Errorf("write datagram to %s failed: %v", s.remote, err)
+			return
+		}
+		metricTunnelBytesOut.Add(float64(n), t.url, t.req.Protocol)
+	}
+}
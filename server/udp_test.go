@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tianhongw/grp/pkg/conn"
+	"github.com/tianhongw/grp/pkg/message"
+)
+
+// newTestUDPRelay starts a relay for a udp tunnel of c on a local port.
+func newTestUDPRelay(t *testing.T, c *Control) *udpRelay {
+	t.Helper()
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := addTestTunnel(t, c, "udp://nrp.me:"+portOf(pc.LocalAddr()), &message.TunnelRequest{Protocol: "udp"})
+	tunnel.udp = &udpRelay{
+		t:           tunnel,
+		conn:        pc,
+		idleTimeout: getSettings().udpIdleTimeout,
+		sessions:    make(map[string]*udpSession),
+	}
+	t.Cleanup(func() { tunnel.exit() })
+
+	go tunnel.udp.listen()
+
+	return tunnel.udp
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+// offerProxy hands c a proxy connection and returns the client end of it.
+func offerProxy(t *testing.T, c *Control) *testConn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	c.proxies <- &testConn{Conn: server}
+
+	return &testConn{Conn: client}
+}
+
+// dialRelay returns a remote sending datagrams to the public port of r.
+func dialRelay(t *testing.T, r *udpRelay) *net.UDPConn {
+	t.Helper()
+
+	remote, err := net.DialUDP("udp", nil, r.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	return remote
+}
+
+// expectStart reads the proxy start of a session of remote from proxy.
+func expectStart(t *testing.T, proxy *testConn, url string, remote *net.UDPConn) {
+	t.Helper()
+
+	proxy.SetDeadline(time.Now().Add(5 * time.Second))
+	msg, err := message.ReadMsg(proxy)
+	if err != nil {
+		t.Fatalf("read proxy start: %v", err)
+	}
+
+	start, ok := msg.(*message.ProxyStart)
+	if !ok || start.URL != url || start.ClientAddr != remote.LocalAddr().String() {
+		t.Fatalf("proxy start: %+v, want %s from %s", msg, url, remote.LocalAddr())
+	}
+}
+
+func readDatagram(t *testing.T, proxy *testConn) []byte {
+	t.Helper()
+
+	buf := make([]byte, conn.MaxDatagramSize)
+	n, err := conn.ReadDatagram(proxy, buf)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+
+	return buf[:n]
+}
+
+func sessions(r *udpRelay) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
+
+func TestUDPSessions(t *testing.T) {
+	setTestGlobals(t, &settings{udpIdleTimeout: time.Minute, udpMaxSessions: 2})
+
+	c, _ := newTestControl(t, "c1", "alice")
+	r := newTestUDPRelay(t, c)
+
+	// every remote gets a session of its own
+	remotes := []*net.UDPConn{dialRelay(t, r), dialRelay(t, r)}
+	for i, remote := range remotes {
+		proxy := offerProxy(t, c)
+
+		remote.Write([]byte("ping"))
+		expectStart(t, proxy, r.t.url, remote)
+
+		// datagrams keep their boundaries both ways
+		if got := readDatagram(t, proxy); string(got) != "ping" {
+			t.Errorf("remote %d: relayed %q", i, got)
+		}
+		big := bytes.Repeat([]byte{byte(i)}, 1200)
+		remote.Write(big)
+		remote.Write([]byte("x"))
+		if got := readDatagram(t, proxy); !bytes.Equal(got, big) {
+			t.Errorf("remote %d: relayed %d bytes, want %d", i, len(got), len(big))
+		}
+		if got := readDatagram(t, proxy); string(got) != "x" {
+			t.Errorf("remote %d: relayed %q", i, got)
+		}
+
+		for _, b := range [][]byte{[]byte("pong"), bytes.Repeat([]byte{0xff}, 1400)} {
+			if err := conn.WriteDatagram(proxy, b); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, conn.MaxDatagramSize)
+			remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := remote.Read(buf)
+			if err != nil {
+				t.Fatalf("remote %d: read reply: %v", i, err)
+			}
+			if !bytes.Equal(buf[:n], b) {
+				t.Errorf("remote %d: reply of %d bytes, want %d", i, n, len(b))
+			}
+		}
+	}
+
+	if n := sessions(r); n != 2 {
+		t.Fatalf("%d sessions, want 2", n)
+	}
+
+	// a third remote is over the limit, it takes no proxy connection
+	spare := offerProxy(t, c)
+	dialRelay(t, r).Write([]byte("ping"))
+	time.Sleep(50 * time.Millisecond)
+	if n := sessions(r); n != 2 {
+		t.Errorf("%d sessions over the limit of 2", n)
+	}
+	if len(c.proxies) != 1 {
+		t.Error("a refused remote took a proxy connection")
+	}
+	spare.Close()
+	<-c.proxies
+}
+
+func TestUDPSessionExpiry(t *testing.T) {
+	setTestGlobals(t, &settings{udpIdleTimeout: 200 * time.Millisecond, udpMaxSessions: 1})
+
+	c, _ := newTestControl(t, "c1", "alice")
+	r := newTestUDPRelay(t, c)
+	remote := dialRelay(t, r)
+
+	proxy := offerProxy(t, c)
+	remote.Write([]byte("ping"))
+	expectStart(t, proxy, r.t.url, remote)
+	readDatagram(t, proxy)
+
+	// replies keep the session alive
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := conn.WriteDatagram(proxy, []byte("pong")); err != nil {
+			t.Fatalf("session expired while active: %v", err)
+		}
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := remote.Read(make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sessions(r); n != 1 {
+		t.Fatalf("%d sessions, want 1", n)
+	}
+
+	// an idle session ends and closes its proxy connection
+	proxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.ReadDatagram(proxy, make([]byte, conn.MaxDatagramSize)); err != io.EOF {
+		t.Fatalf("proxy connection of an idle session: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sessions(r) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle session was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// which frees its place for a new one of the same remote
+	proxy = offerProxy(t, c)
+	remote.Write([]byte("again"))
+	expectStart(t, proxy, r.t.url, remote)
+	if got := readDatagram(t, proxy); string(got) != "again" {
+		t.Errorf("relayed %q", got)
+	}
+}
+
+func TestUDPSessionsClosedWithTunnel(t *testing.T) {
+	setTestGlobals(t, &settings{udpIdleTimeout: time.Minute, udpMaxSessions: 1})
+
+	c, _ := newTestControl(t, "c1", "alice")
+	r := newTestUDPRelay(t, c)
+	remote := dialRelay(t, r)
+
+	proxy := offerProxy(t, c)
+	remote.Write([]byte("ping"))
+	expectStart(t, proxy, r.t.url, remote)
+	readDatagram(t, proxy)
+
+	c.killTunnel(r.t)
+
+	proxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.ReadDatagram(proxy, make([]byte, conn.MaxDatagramSize)); err != io.EOF {
+		t.Errorf("proxy connection after the tunnel exited: %v", err)
+	}
+}
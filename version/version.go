@@ -10,3 +10,13 @@ var (
 	GitCommitTime = ""                                  // git log -1 --format=%cd --date=format:'%a %b %d %Y %H:%M:%S GMT%z'
 	BuildTime     = time.Now().Format(time.RFC3339Nano) // date +"%a %b %d %Y %H:%M:%S GMT%z"
 )
+
+const (
+	// ProtocolVersion is the version of the messages exchanged between nrpc
+	// and nrps, bump it whenever a message changes incompatibly.
+	ProtocolVersion = 8
+
+	// MinProtocolVersion is the oldest protocol version still understood,
+	// 0 stands for peers predating the version negotiation.
+	MinProtocolVersion = 0
+)